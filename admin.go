@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// the flags whose values must never leave the process
+var secretFlags = map[string]bool{
+	"admin-token":       true,
+	"backend-via-proxy": true,
+}
+
+// start the admin listener,
+// it serves the default mux which also carries the expvar metrics on /debug/vars .
+func serveAdmin() {
+	http.HandleFunc("/config", configHandler)
+	http.HandleFunc("/acme", acmeHandler)
+	http.HandleFunc("/health", healthHandler)
+	ln := listenUpgradable("admin", *adminListen, func(addr string) net.Listener {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return ln
+	})
+	log.Fatal(http.Serve(ln, auditAdmin(adminAuth(http.DefaultServeMux))))
+}
+
+// whether the specified listen address only accepts local connections
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// require the "Authorization: Bearer <-admin-token>" header when a token is set
+func adminAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *adminToken != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// dump the effective configuration as json
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	options := map[string]string{}
+	flag.VisitAll(func(f *flag.Flag) {
+		options[f.Name] = f.Value.String()
+		if secretFlags[f.Name] && options[f.Name] != "" {
+			options[f.Name] = "[redacted]"
+		}
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"domains":     domain_backend,
+		"whitelisted": whitelisted,
+		"options":     options,
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// an audit log entry of an operational change
+type auditEntry struct {
+	Time      time.Time   `json:"time"`
+	Action    string      `json:"action"`
+	Principal string      `json:"principal"`
+	Source    string      `json:"source"`
+	Before    interface{} `json:"before,omitempty"`
+	After     interface{} `json:"after,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// the -audit-log file, nil when auditing is off
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+)
+
+// open the -audit-log file for appending
+func openAuditLog() {
+	if *auditLog == "" {
+		return
+	}
+	var err error
+	if auditFile, err = os.OpenFile(*auditLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		log.Fatalf("-audit-log: %v", err)
+	}
+}
+
+// append the entry to the audit log as a json line
+func audit(entry auditEntry) {
+	if auditFile == nil {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("audit: %v", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		log.Printf("audit: %v", err)
+	}
+}
+
+// the admin endpoints whose reads are audited, since they dump the configuration and the acme account
+var auditedReads = map[string]bool{"/config": true, "/acme": true}
+
+// audit the admin requests that may change something, that is all but GET and HEAD, and the reads of auditedReads,
+// the caller is known by the admin token when one is set and by its address otherwise,
+// the attempts that fail to authenticate are audited too .
+// the admin endpoints only read for now, so their entries carry no before and after state,
+// which is recorded by the reloads and upgrades .
+func auditAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		read := r.Method == http.MethodGet || r.Method == http.MethodHead
+		if read && !auditedReads[r.URL.Path] && sw.code != http.StatusUnauthorized {
+			return
+		}
+		principal := "anonymous"
+		if sw.code == http.StatusUnauthorized {
+			principal = "unauthenticated"
+		} else if *adminToken != "" {
+			principal = "admin-token"
+		}
+		source, _, _ := net.SplitHostPort(r.RemoteAddr)
+		entry := auditEntry{Action: r.Method + " " + r.URL.Path, Principal: principal, Source: source}
+		if sw.code >= http.StatusBadRequest {
+			entry.Error = http.StatusText(sw.code)
+		}
+		audit(entry)
+	})
+}
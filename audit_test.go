@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditAdmin(t *testing.T) {
+	defer func(saved *os.File, token string) { auditFile, *adminToken = saved, token }(auditFile, *adminToken)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	if auditFile, err = os.Create(path); err != nil {
+		t.Fatal(err)
+	}
+	defer auditFile.Close()
+	*adminToken = "secret"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	h := auditAdmin(adminAuth(mux))
+	for _, tt := range []struct{ method, path, token string }{
+		{"GET", "/config", "secret"},
+		{"GET", "/health", "secret"},
+		{"GET", "/health", "wrong"},
+		{"POST", "/health", "secret"},
+	} {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var entry auditEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got = append(got, entry.Action+" "+entry.Principal)
+	}
+	want := []string{"GET /config admin-token", "GET /health unauthenticated", "POST /health admin-token"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("audited %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// a response writer that holds back the whole response so it can be rewritten,
+// only the responses accepted by the accept func are held back, and the ones
+// that outgrow -max-transform-size or are event streams are passed through as is .
+type bufferedWriter struct {
+	http.ResponseWriter
+	accept      func(code int, h http.Header) bool
+	code        int
+	buf         bytes.Buffer
+	buffering   bool
+	wroteHeader bool
+}
+
+// create a buffered writer on top of the specified response writer
+func newBufferedWriter(w http.ResponseWriter, accept func(code int, h http.Header) bool) *bufferedWriter {
+	return &bufferedWriter{ResponseWriter: w, accept: accept, code: http.StatusOK}
+}
+
+func (bw *bufferedWriter) WriteHeader(code int) {
+	if bw.wroteHeader {
+		return
+	}
+	bw.wroteHeader = true
+	bw.code = code
+	if bw.accept(code, bw.Header()) {
+		// a rewritten body gets a Content-Length which rules out trailers,
+		// so the responses announcing trailers are relayed untouched instead .
+		if trailer := bw.Header().Get("Trailer"); trailer != "" {
+			log.Printf("response announces the %s trailers, relaying it without rewriting", trailer)
+		} else {
+			bw.buffering = true
+			return
+		}
+	}
+	bw.ResponseWriter.WriteHeader(code)
+}
+
+func (bw *bufferedWriter) Write(b []byte) (int, error) {
+	if !bw.wroteHeader {
+		if bw.Header().Get("Content-Type") == "" {
+			bw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		bw.WriteHeader(http.StatusOK)
+	}
+	if !bw.buffering {
+		return bw.ResponseWriter.Write(b)
+	}
+	if bw.buf.Len()+len(b) > *maxTransformSize {
+		bw.passThrough()
+		return bw.ResponseWriter.Write(b)
+	}
+	return bw.buf.Write(b)
+}
+
+// the reverse proxy flushes after every write of a chunked response, so the
+// flushes are ignored while buffering unless the response is an event stream .
+func (bw *bufferedWriter) Flush() {
+	if bw.buffering {
+		if mediaTypeOf(bw.Header()) != "text/event-stream" {
+			return
+		}
+		bw.passThrough()
+	}
+	if f, ok := bw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// stop buffering and send what has been held back so far
+func (bw *bufferedWriter) passThrough() {
+	bw.buffering = false
+	bw.ResponseWriter.WriteHeader(bw.code)
+	bw.ResponseWriter.Write(bw.buf.Bytes())
+	bw.buf.Reset()
+}
+
+// the held back body, ok is false when the response has been passed through
+func (bw *bufferedWriter) body() (body []byte, ok bool) {
+	if !bw.wroteHeader || !bw.buffering {
+		return nil, false
+	}
+	return bw.buf.Bytes(), true
+}
+
+// a least recently used cache bounded by its entries and by their total size
+type lru struct {
+	mu       sync.Mutex
+	max      int
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key   string
+	value interface{}
+	size  int64
+}
+
+// create a cache holding up to max entries of up to maxBytes in total, 0 means no size bound
+func newLRU(max int, maxBytes int64) *lru {
+	return &lru{max: max, maxBytes: maxBytes, ll: list.New(), items: map[string]*list.Element{}}
+}
+
+// get the cached value of the specified key
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).value, true
+}
+
+// cache the specified value of the specified size, evicting the least recently used entries
+// till the cache is within its bounds again, a value larger than maxBytes isn't kept at all .
+func (c *lru) add(key string, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.items[key]
+	if c.maxBytes > 0 && size > c.maxBytes {
+		if found {
+			c.ll.Remove(e)
+			delete(c.items, key)
+			c.bytes -= e.Value.(*lruEntry).size
+		}
+		return
+	}
+	if found {
+		c.ll.MoveToFront(e)
+		entry := e.Value.(*lruEntry)
+		c.bytes += size - entry.size
+		entry.value, entry.size = value, size
+	} else {
+		c.items[key] = c.ll.PushFront(&lruEntry{key, value, size})
+		c.bytes += size
+	}
+	for c.ll.Len() > c.max || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		entry := oldest.Value.(*lruEntry)
+		delete(c.items, entry.key)
+		c.bytes -= entry.size
+	}
+}
+
+// a response writer that records the status code and the body size
+type statusWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.code == 0 {
+		sw.code = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.code == 0 {
+		sw.code = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// hijacking is passed through for the websocket proxy
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	sw.code = http.StatusSwitchingProtocols
+	return hj.Hijack()
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	gz "compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	"github.com/tdewolff/minify"
+)
+
+// proxy to a backend that streams its body in chunks, flushing after each write
+func chunkedProxy(t *testing.T, contentType string, chunks ...string) http.Handler {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		for _, chunk := range chunks {
+			io.WriteString(w, chunk)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	t.Cleanup(backend.Close)
+	target, _ := url.Parse(backend.URL)
+	return httputil.NewSingleHostReverseProxy(target)
+}
+
+func TestBufferedWriterChunkedResponse(t *testing.T) {
+	h := chunkedProxy(t, "text/html", "<p>one</p>", "<p>two</p>")
+	rec := httptest.NewRecorder()
+	bw := newBufferedWriter(rec, func(code int, hdr http.Header) bool { return true })
+	h.ServeHTTP(bw, httptest.NewRequest("GET", "/", nil))
+	body, ok := bw.body()
+	if !ok {
+		t.Fatal("the chunked response was passed through instead of buffered")
+	}
+	if string(body) != "<p>one</p><p>two</p>" {
+		t.Fatalf("buffered %q", body)
+	}
+	if rec.Body.Len() != 0 || rec.Flushed {
+		t.Fatalf("the buffered response reached the client: %q", rec.Body.String())
+	}
+}
+
+func TestBufferedWriterEventStream(t *testing.T) {
+	h := chunkedProxy(t, "text/event-stream", "data: one\n\n", "data: two\n\n")
+	rec := httptest.NewRecorder()
+	bw := newBufferedWriter(rec, func(code int, hdr http.Header) bool { return true })
+	h.ServeHTTP(bw, httptest.NewRequest("GET", "/", nil))
+	if _, ok := bw.body(); ok {
+		t.Fatal("the event stream was buffered")
+	}
+	if rec.Body.String() != "data: one\n\ndata: two\n\n" || !rec.Flushed {
+		t.Fatalf("the event stream wasn't passed through: %q", rec.Body.String())
+	}
+}
+
+func TestBufferedWriterMaxTransformSize(t *testing.T) {
+	defer func(max int) { *maxTransformSize = max }(*maxTransformSize)
+	*maxTransformSize = 8
+	h := chunkedProxy(t, "text/html", "<p>one</p>", "<p>two</p>")
+	rec := httptest.NewRecorder()
+	bw := newBufferedWriter(rec, func(code int, hdr http.Header) bool { return true })
+	h.ServeHTTP(bw, httptest.NewRequest("GET", "/", nil))
+	if _, ok := bw.body(); ok {
+		t.Fatal("the response outgrowing -max-transform-size was buffered")
+	}
+	if rec.Body.String() != "<p>one</p><p>two</p>" {
+		t.Fatalf("passed through %q", rec.Body.String())
+	}
+}
+
+func TestTransformHandlerChunkedResponse(t *testing.T) {
+	defer func(saved []transformer) { transformers = saved }(transformers)
+	transformers = []transformer{func(r *http.Request, h http.Header) func([]byte) []byte {
+		return bytes.ToUpper
+	}}
+	h := transformHandler(chunkedProxy(t, "text/html", "<p>one</p>", "<p>two</p>"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "<P>ONE</P><P>TWO</P>" {
+		t.Fatalf("the chunked response wasn't transformed: %q", rec.Body.String())
+	}
+	if rec.Header().Get("Content-Length") != "20" {
+		t.Fatalf("Content-Length %q", rec.Header().Get("Content-Length"))
+	}
+}
+
+// serve the handler in front of a proxy to a backend that sends a checksum trailer,
+// returning the response body and trailer as read by a client .
+func trailerRequest(t *testing.T, wrap func(http.Handler) http.Handler, acceptEncoding string) (string, *http.Response) {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Trailer", "Checksum")
+		io.WriteString(w, "<p>body</p>")
+		w.Header().Set("Checksum", "abc")
+	}))
+	defer backend.Close()
+	target, _ := url.Parse(backend.URL)
+	server := httptest.NewServer(wrap(httputil.NewSingleHostReverseProxy(target)))
+	defer server.Close()
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	if acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var body io.Reader = res.Body
+	if res.Header.Get("Content-Encoding") == "gzip" {
+		if body, err = gz.NewReader(res.Body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	return string(b), res
+}
+
+func TestTrailersRelayed(t *testing.T) {
+	body, res := trailerRequest(t, func(h http.Handler) http.Handler { return h }, "")
+	if body != "<p>body</p>" || res.Trailer.Get("Checksum") != "abc" {
+		t.Fatalf("got %q with trailers %v", body, res.Trailer)
+	}
+}
+
+func TestTrailersRelayedThroughCompression(t *testing.T) {
+	body, res := trailerRequest(t, func(h http.Handler) http.Handler {
+		return compressTypesHandler(h, 6, nil, nil)
+	}, "gzip")
+	if res.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("the response wasn't compressed")
+	}
+	if body != "<p>body</p>" || res.Trailer.Get("Checksum") != "abc" {
+		t.Fatalf("got %q with trailers %v", body, res.Trailer)
+	}
+}
+
+func TestTrailersRelayedUnrewritten(t *testing.T) {
+	defer func(saved []transformer) { transformers = saved }(transformers)
+	transformers = []transformer{func(r *http.Request, h http.Header) func([]byte) []byte {
+		return bytes.ToUpper
+	}}
+	body, res := trailerRequest(t, transformHandler, "")
+	// the rewritten body would need a Content-Length, which rules out its trailers
+	if body != "<p>body</p>" || res.Trailer.Get("Checksum") != "abc" {
+		t.Fatalf("got %q with trailers %v", body, res.Trailer)
+	}
+}
+
+func TestLRUBoundedByBytes(t *testing.T) {
+	c := newLRU(100, 10)
+	c.add("a", "a", 4)
+	c.add("b", "b", 4)
+	c.get("a")
+	c.add("c", "c", 4)
+	if _, found := c.get("b"); found {
+		t.Fatal("the least recently used entry wasn't evicted past maxBytes")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, found := c.get(key); !found {
+			t.Fatalf("%s was evicted", key)
+		}
+	}
+	c.add("a", "a", 8)
+	if _, found := c.get("c"); found || c.bytes != 8 {
+		t.Fatalf("the grown entry didn't evict the others, %d bytes", c.bytes)
+	}
+	c.add("huge", "huge", 11)
+	if _, found := c.get("huge"); found {
+		t.Fatal("an entry larger than maxBytes was kept")
+	}
+	if _, found := c.get("a"); !found || c.bytes != 8 {
+		t.Fatalf("an entry larger than maxBytes evicted the others, %d bytes", c.bytes)
+	}
+}
+
+func TestMinifyCacheHandlerHead(t *testing.T) {
+	m := minify.New()
+	m.AddFunc("text/html", func(m *minify.M, w io.Writer, r io.Reader, params map[string]string) error {
+		b, err := io.ReadAll(r)
+		w.Write(bytes.ReplaceAll(b, []byte(" "), nil))
+		return err
+	})
+	h := minifyCacheHandler(m, newLRU(10, 1<<20), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", "11")
+		// like the reverse proxy, which writes the header of a bodyless response explicitly
+		w.WriteHeader(http.StatusOK)
+		if r.Method != http.MethodHead {
+			io.WriteString(w, "<p> one</p>")
+		}
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/", nil))
+	if rec.Header().Get("Content-Length") != "11" {
+		t.Fatalf("the HEAD response has Content-Length %q, want 11", rec.Header().Get("Content-Length"))
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Body.String() != "<p>one</p>" || rec.Header().Get("Content-Length") != "10" {
+		t.Fatalf("the GET response was minified to %q, Content-Length %q", rec.Body.String(), rec.Header().Get("Content-Length"))
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the backend responses kept around to be served stale when the backend fails,
+// it is nil when -stale-cache-size is zero .
+var staleCache *lru
+
+// a copy of a backend response
+type cachedResponse struct {
+	code    int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// an extra cache key component, a request header or cookie,
+// the query parameters are always part of the key with the rest of the url .
+type keyComponent struct {
+	kind string
+	name string
+}
+
+// the extra cache key components under a path prefix of a domain
+type cacheKeyRule struct {
+	prefix     string
+	components []keyComponent
+}
+
+// the cache key rules of each domain, the longest prefix first
+var domain_cache_key = map[string][]cacheKeyRule{}
+
+// parse the -cache-key flag of domain[/path-prefix]->header:Name|cookie:name
+func parseCacheKeys(s string) {
+	for zone, value := range parseZones(s) {
+		domain, prefix := zone, "/"
+		if i := strings.Index(zone, "/"); i >= 0 {
+			domain, prefix = zone[:i], zone[i:]
+		}
+		rule := cacheKeyRule{prefix: prefix}
+		for _, item := range strings.Split(value, "|") {
+			kind, name, _ := strings.Cut(strings.TrimSpace(item), ":")
+			kind = strings.ToLower(kind)
+			if (kind != "header" && kind != "cookie") || name == "" {
+				log.Fatalf("-cache-key: %s: %q, want header:Name or cookie:name", zone, item)
+			}
+			if kind == "header" {
+				name = http.CanonicalHeaderKey(name)
+			}
+			rule.components = append(rule.components, keyComponent{kind, name})
+		}
+		rules := append(domain_cache_key[domain], rule)
+		for i := len(rules) - 1; i > 0 && len(rules[i].prefix) > len(rules[i-1].prefix); i-- {
+			rules[i], rules[i-1] = rules[i-1], rules[i]
+		}
+		domain_cache_key[domain] = rules
+	}
+}
+
+// the extra cache key components of the specified request, nil when there is none
+func cacheKeyComponents(r *http.Request) []keyComponent {
+	for _, rule := range domain_cache_key[r.Host] {
+		if strings.HasPrefix(r.URL.Path, rule.prefix) {
+			return rule.components
+		}
+	}
+	return nil
+}
+
+// the cache key of the specified request
+func cacheKey(r *http.Request) string {
+	key := r.Host + r.URL.RequestURI() + "\x00" + r.Header.Get("Accept-Encoding")
+	for _, c := range cacheKeyComponents(r) {
+		value := ""
+		switch c.kind {
+		case "header":
+			value = strings.Join(r.Header.Values(c.name), ",")
+		case "cookie":
+			if cookie, err := r.Cookie(c.name); err == nil {
+				value = cookie.Value
+			}
+		}
+		key += "\x00" + c.kind + ":" + c.name + "=" + value
+	}
+	return key
+}
+
+// whether the cache key of the request covers every header the response varies on,
+// that is Accept-Encoding and the headers of its -cache-key .
+func varyCovered(r *http.Request, vary []string) bool {
+	for _, value := range vary {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || name == "Accept-Encoding" {
+				continue
+			}
+			covered := false
+			for _, c := range cacheKeyComponents(r) {
+				covered = covered || (c.kind == "header" && c.name == name)
+			}
+			if !covered {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// parse the directives of a Cache-Control header
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, directive := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if parts[0] == "" {
+			continue
+		}
+		if len(parts) < 2 {
+			parts = append(parts, "")
+		}
+		directives[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+	}
+	return directives
+}
+
+// remember the response of the specified request once its body has been read,
+// it may then be served stale till its max-age plus its stale-if-error window
+// or -stale-if-error when it doesn't specify one .
+// it returns whether the response is being stored .
+func storeStale(r *http.Request, res *http.Response) bool {
+	if staleCache == nil || r.Method != http.MethodGet || res.StatusCode != http.StatusOK || res.Header.Get("Set-Cookie") != "" || len(res.Trailer) > 0 {
+		return false
+	}
+	if !varyCovered(r, res.Header.Values("Vary")) {
+		return false
+	}
+	cc := parseCacheControl(res.Header.Get("Cache-Control"))
+	if _, found := cc["no-store"]; found {
+		return false
+	}
+	if _, found := cc["private"]; found {
+		return false
+	}
+	// the response to a request with credentials may be personalized, like in coalescable
+	if r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != "" {
+		_, public := cc["public"]
+		if _, found := cc["s-maxage"]; !public && !found {
+			return false
+		}
+	}
+	window := *staleIfError
+	if v, found := cc["stale-if-error"]; found {
+		seconds, _ := strconv.Atoi(v)
+		window = time.Duration(seconds) * time.Second
+	}
+	if window <= 0 {
+		return false
+	}
+	maxAge, _ := strconv.Atoi(cc["max-age"])
+	key, header := cacheKey(r), res.Header.Clone()
+	expires := time.Now().Add(time.Duration(maxAge)*time.Second + window)
+	res.Body = &captureBody{ReadCloser: res.Body, done: func(body []byte) {
+		staleCache.add(key, &cachedResponse{res.StatusCode, header, body, expires}, int64(len(body)))
+	}}
+	return true
+}
+
+// the stale response of the specified request, nil when there is none
+func staleResponse(r *http.Request) *cachedResponse {
+	if staleCache == nil || r.Method != http.MethodGet {
+		return nil
+	}
+	v, found := staleCache.get(cacheKey(r))
+	if !found || time.Now().After(v.(*cachedResponse).expires) {
+		return nil
+	}
+	return v.(*cachedResponse)
+}
+
+// replace a failed backend response with the stale one if any
+func replaceWithStale(r *http.Request, res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+	default:
+		return false
+	}
+	stale := staleResponse(r)
+	if stale == nil {
+		return false
+	}
+	res.Body.Close()
+	res.StatusCode = stale.code
+	res.Header = stale.header.Clone()
+	res.Header.Add("Warning", `110 - "Response is Stale"`)
+	res.Body = io.NopCloser(bytes.NewReader(stale.body))
+	res.ContentLength = int64(len(stale.body))
+	return true
+}
+
+// write the stale response of the specified request if any
+func serveStale(w http.ResponseWriter, r *http.Request) bool {
+	stale := staleResponse(r)
+	if stale == nil {
+		return false
+	}
+	for k, v := range stale.header {
+		w.Header()[k] = v
+	}
+	w.Header().Add("Warning", `110 - "Response is Stale"`)
+	setCacheStatus(r, w.Header(), "STALE")
+	w.WriteHeader(stale.code)
+	w.Write(stale.body)
+	return true
+}
+
+// set the -cache-status-header of the response to the specified request
+// to HIT, MISS, STALE or BYPASS when the domain has some caching going on .
+func setCacheStatus(r *http.Request, h http.Header, status string) {
+	if *cacheStatusHeader != "" && (staleCache != nil || domain_coalesce[r.Host]) {
+		h.Set(*cacheStatusHeader, status)
+	}
+}
+
+// a response body that hands over a copy of itself once fully read,
+// bodies larger than -max-transform-size aren't copied .
+type captureBody struct {
+	io.ReadCloser
+	buf      bytes.Buffer
+	overflow bool
+	done     func(body []byte)
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if !c.overflow {
+		if c.buf.Len()+n > *maxTransformSize {
+			c.overflow = true
+			c.buf.Reset()
+		} else {
+			c.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !c.overflow {
+		c.overflow = true
+		c.done(c.buf.Bytes())
+	}
+	return n, err
+}
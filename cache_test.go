@@ -0,0 +1,46 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// store the response of the specified request in a fresh stale cache and read its body
+func storeStaleResponse(t *testing.T, r *http.Request, cacheControl string) bool {
+	t.Helper()
+	res := &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Cache-Control": {cacheControl}},
+		Body:       io.NopCloser(strings.NewReader("personal")),
+	}
+	stored := storeStale(r, res)
+	io.ReadAll(res.Body)
+	return stored
+}
+
+func TestStaleCacheSkipsCredentials(t *testing.T) {
+	defer func(saved *lru) { staleCache = saved }(staleCache)
+	for _, tt := range []struct {
+		header, value, cacheControl string
+		stored                      bool
+	}{
+		{"Authorization", "Bearer secret", "max-age=60, stale-if-error=60", false},
+		{"Cookie", "session=secret", "max-age=60, stale-if-error=60", false},
+		{"Authorization", "Bearer secret", "public, max-age=60, stale-if-error=60", true},
+		{"Cookie", "session=secret", "s-maxage=60, stale-if-error=60", true},
+	} {
+		staleCache = newLRU(10, 1<<20)
+		r := httptest.NewRequest("GET", "https://a.test/account", nil)
+		r.Header.Set(tt.header, tt.value)
+		if stored := storeStaleResponse(t, r, tt.cacheControl); stored != tt.stored {
+			t.Errorf("%s with %q: stored %v, want %v", tt.header, tt.cacheControl, stored, tt.stored)
+		}
+		anonymous := httptest.NewRequest("GET", "https://a.test/account", nil)
+		if served := staleResponse(anonymous) != nil; served != tt.stored {
+			t.Errorf("%s with %q: served stale to an anonymous request %v, want %v", tt.header, tt.cacheControl, served, tt.stored)
+		}
+	}
+}
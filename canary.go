@@ -0,0 +1,113 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a canary backend getting a share of the traffic of a domain
+// till its 5xx rate over a -canary-window exceeds -canary-max-error-rate .
+type canary struct {
+	url     string
+	host    string
+	percent float64
+
+	mu         sync.Mutex
+	start      time.Time
+	requests   int
+	errors     int
+	errorRate  float64
+	rolledBack bool
+}
+
+// the canary of each domain
+var domain_canary = map[string]*canary{}
+
+// parse the -canary flag of domain:percent%->[ip]:port
+func parseCanaries(s string) {
+	for zone, backend := range parseZones(s) {
+		domain, share, found := strings.Cut(zone, ":")
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(share, "%"), 64)
+		if !found || err != nil || percent < 0 || percent > 100 || backend == "" {
+			log.Fatalf("-canary: %s: want domain:percent%%->[ip]:port", zone)
+		}
+		c := &canary{url: fixUrl(backend), percent: percent, start: time.Now()}
+		u, err := url.Parse(c.url)
+		if err != nil {
+			log.Fatalf("-canary: %s: %v", zone, err)
+		}
+		c.host = u.Host
+		domain_canary[domain] = c
+	}
+	if len(domain_canary) > 0 {
+		expvar.Publish("canary", expvar.Func(canaryStats))
+	}
+}
+
+// the canary backend picked for a request of the specified domain, empty when the regular backend serves it
+func canaryBackend(domain string) string {
+	c, found := domain_canary[domain]
+	if !found {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rolledBack || rand.Float64()*100 >= c.percent {
+		return ""
+	}
+	return c.url
+}
+
+// record the status of a response of the specified backend of a domain,
+// rolling the canary back once its 5xx rate over a full window is too high .
+func recordCanary(domain, host string, code int) {
+	c, found := domain_canary[domain]
+	if !found || c.host != host {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rolledBack {
+		return
+	}
+	if now := time.Now(); now.Sub(c.start) > *canaryWindow {
+		c.start, c.requests, c.errors = now, 0, 0
+	}
+	c.requests++
+	if code >= 500 {
+		c.errors++
+	}
+	c.errorRate = float64(c.errors) * 100 / float64(c.requests)
+	if c.requests >= *canaryMinRequests && c.errorRate > *canaryMaxErrorRate {
+		c.rolledBack = true
+		log.Printf("%s: canary %s rolled back, %d of its last %d responses failed", domain, c.url, c.errors, c.requests)
+	}
+}
+
+// the traffic share and error rate of each canary
+func canaryStats() interface{} {
+	stats := map[string]interface{}{}
+	for domain, c := range domain_canary {
+		c.mu.Lock()
+		share := c.percent
+		if c.rolledBack {
+			share = 0
+		}
+		stats[domain] = map[string]interface{}{
+			"backend":     c.url,
+			"share":       share,
+			"error_rate":  c.errorRate,
+			"requests":    c.requests,
+			"errors":      c.errors,
+			"rolled_back": c.rolledBack,
+		}
+		c.mu.Unlock()
+	}
+	return stats
+}
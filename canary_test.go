@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestCanaryRollbackOnBaseDomainSubdomain(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	defer func(backends map[string]string, canaries map[string]*canary, bases []string, min int) {
+		domain_backend, domain_canary, baseDomains, *canaryMinRequests = backends, canaries, bases, min
+	}(domain_backend, domain_canary, baseDomains, *canaryMinRequests)
+	u, _ := url.Parse(failing.URL)
+	c := &canary{url: failing.URL, host: u.Host, percent: 100, start: time.Now()}
+	domain_backend = map[string]string{"a.test": "http://127.0.0.1:1"}
+	domain_canary = map[string]*canary{"a.test": c}
+	baseDomains = []string{"a.test"}
+	*canaryMinRequests = 5
+
+	for i := 0; i < *canaryMinRequests; i++ {
+		r := httptest.NewRequest("GET", "https://x.a.test/", nil)
+		r.Host = "x.a.test"
+		backend := backendOf(r)
+		if backend != failing.URL {
+			t.Fatalf("request %d went to %q rather than the canary", i, backend)
+		}
+		target, _ := url.Parse(backend + "/")
+		serveProxy(httptest.NewRecorder(), r, target, map[string]bool{target.Host: true})
+	}
+	if !c.rolledBack {
+		t.Fatalf("the canary wasn't rolled back after %d errors of %d requests", c.errors, c.requests)
+	}
+	r := httptest.NewRequest("GET", "https://x.a.test/", nil)
+	r.Host = "x.a.test"
+	if backend := backendOf(r); backend != domain_backend["a.test"] {
+		t.Fatalf("the rolled back canary still serves, got %q", backend)
+	}
+}
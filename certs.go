@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the certificate manager
+var certManager *autocert.Manager
+
+// what has been seen of the certificate of a domain
+type certState struct {
+	NotAfter    time.Time `json:"not_after"`
+	RenewedAt   time.Time `json:"renewed_at,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+}
+
+// the certificate state of each domain
+var (
+	certStatesMu sync.Mutex
+	certStates   = map[string]*certState{}
+)
+
+func init() {
+	expvar.Publish("cert_expiry_seconds", expvar.Func(func() interface{} {
+		certStatesMu.Lock()
+		defer certStatesMu.Unlock()
+		seconds := map[string]int64{}
+		for domain, state := range certStates {
+			if !state.NotAfter.IsZero() {
+				seconds[domain] = int64(time.Until(state.NotAfter).Seconds())
+			}
+		}
+		return seconds
+	}))
+}
+
+// the state of the specified domain certificate, the caller must hold certStatesMu
+func certStateOf(domain string) *certState {
+	state, found := certStates[domain]
+	if !found {
+		state = &certState{}
+		certStates[domain] = state
+	}
+	return state
+}
+
+// remember the expiry of the specified domain certificate,
+// a later expiry than the known one means the certificate got renewed .
+func recordCertExpiry(domain string, leaf *x509.Certificate) {
+	certStatesMu.Lock()
+	defer certStatesMu.Unlock()
+	state := certStateOf(domain)
+	if !state.NotAfter.IsZero() && leaf.NotAfter.After(state.NotAfter) {
+		state.RenewedAt = time.Now()
+	}
+	state.NotAfter = leaf.NotAfter
+}
+
+// remember the failure to get the specified domain certificate
+func recordCertError(domain string, err error) {
+	certStatesMu.Lock()
+	defer certStatesMu.Unlock()
+	state := certStateOf(domain)
+	state.LastError = err.Error()
+	state.LastErrorAt = time.Now()
+}
+
+// wrap the certificate getter to remember the expiry of the served certificates
+func trackCertificates(get func(*tls.ClientHelloInfo) (*tls.Certificate, error)) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := get(hello)
+		if err != nil && hello.ServerName != "" {
+			recordCertError(hello.ServerName, err)
+		}
+		if err != nil || cert == nil || len(cert.Certificate) == 0 {
+			return cert, err
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if leaf != nil {
+			recordCertExpiry(hello.ServerName, leaf)
+		}
+		return cert, err
+	}
+}
+
+// the leaf certificate of the specified domain in the autocert cache, nil when there is none
+func cachedCertificate(cache autocert.Cache, domain string) *x509.Certificate {
+	data, err := cache.Get(context.Background(), domain)
+	if err != nil {
+		return nil
+	}
+	// the cache entry holds the private key followed by the certificate chain
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			leaf, _ := x509.ParseCertificate(block.Bytes)
+			return leaf
+		}
+	}
+	return nil
+}
+
+// load the expiry of the cached certificates so it is known before the first handshake
+func loadCertExpiry(cache autocert.Cache, domains []string) {
+	for _, domain := range domains {
+		if leaf := cachedCertificate(cache, domain); leaf != nil {
+			recordCertExpiry(domain, leaf)
+		}
+	}
+}
+
+// the status of the acme account whose key is in the cache, as the directory reports it,
+// nil when there is no account yet .
+func acmeAccount(ctx context.Context, directory string) (map[string]interface{}, error) {
+	data, err := certManager.Cache.Get(ctx, "acme_account+key")
+	if errors.Is(err, autocert.ErrCacheMiss) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("the cached account key isn't pem encoded")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	account, err := (&acme.Client{Key: key, DirectoryURL: directory}).GetReg(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"uri":     account.URI,
+		"status":  account.Status,
+		"contact": account.Contact,
+	}, nil
+}
+
+// dump the acme state as json, the account and certificate keys are never included .
+// the states are copied first so the cache reads don't hold up the handshakes recording theirs .
+func acmeHandler(w http.ResponseWriter, r *http.Request) {
+	directory := acme.LetsEncryptURL
+	if certManager.Client != nil && certManager.Client.DirectoryURL != "" {
+		directory = certManager.Client.DirectoryURL
+	}
+	states := map[string]certState{}
+	certStatesMu.Lock()
+	for _, domain := range whitelisted {
+		if known, found := certStates[domain]; found {
+			states[domain] = *known
+		}
+	}
+	certStatesMu.Unlock()
+	domains := map[string]interface{}{}
+	for _, domain := range whitelisted {
+		state := states[domain]
+		leaf := cachedCertificate(certManager.Cache, domain)
+		if leaf != nil {
+			state.NotAfter = leaf.NotAfter
+		}
+		domains[domain] = map[string]interface{}{
+			"cached": leaf != nil,
+			"state":  state,
+		}
+	}
+	status := map[string]interface{}{
+		"directory": directory,
+		"domains":   domains,
+	}
+	account, err := acmeAccount(r.Context(), directory)
+	status["account_key_cached"] = account != nil || err != nil
+	if err != nil {
+		status["account_error"] = err.Error()
+	} else if account != nil {
+		status["account"] = account
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// the charset of each domain given to its text responses that lack one
+var domain_charset = map[string]string{}
+
+// parse the -default-charset flag of domain->charset, utf-8 when no charset is given
+func parseDefaultCharset(s string) {
+	for domain, charset := range parseZones(s) {
+		if charset == "" {
+			charset = "utf-8"
+		}
+		domain_charset[domain] = charset
+	}
+}
+
+// add the default charset of the domain to a text Content-Type without any,
+// an explicit charset is never overridden .
+func setDefaultCharset(domain string, h http.Header) {
+	charset, found := domain_charset[domain]
+	if !found {
+		return
+	}
+	contentType := h.Get("Content-Type")
+	mediatype, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediatype, "text/") || params["charset"] != "" {
+		return
+	}
+	h.Set("Content-Type", contentType+"; charset="+charset)
+}
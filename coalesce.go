@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// the in flight backend requests shared by identical concurrent requests
+var coalescing singleflight.Group
+
+// the domains whose identical concurrent requests share a single backend request
+var domain_coalesce = map[string]bool{}
+
+// parse the -coalesce flag of domains
+func parseCoalesce(s string) {
+	for domain := range parseZones(s) {
+		domain_coalesce[domain] = true
+	}
+}
+
+// whether the request may share the backend request of an identical one,
+// that is an anonymous GET on a domain with coalescing enabled .
+func coalescable(r *http.Request) bool {
+	return domain_coalesce[r.Host] && r.Method == http.MethodGet && r.Header.Get("Authorization") == "" && r.Header.Get("Cookie") == ""
+}
+
+// a coalesced backend response, whether it may be handed to the other waiters
+// and the request headers it was made with, to be compared with theirs per Vary .
+type coalescedResponse struct {
+	res       *cachedResponse
+	shareable bool
+	streamed  bool
+	request   http.Header
+}
+
+// proxy the request to the backend, the identical requests arriving meanwhile
+// wait for it and get the same response when it is a cacheable one .
+// the shared backend request isn't cancelled by the client that started it going away,
+// unless its response outgrows -max-transform-size or is an event stream, in which
+// case it is streamed to that client alone and the waiters make their own request .
+func serveCoalesced(w http.ResponseWriter, r *http.Request, u *url.URL) {
+	leader := false
+	done := make(chan struct{})
+	v, _, _ := coalescing.Do(cacheKey(r), func() (interface{}, error) {
+		leader = true
+		var ctx context.Context
+		var cancel context.CancelFunc
+		if timeout := timeoutOf(r.Host, r.URL.Path); timeout > 0 {
+			ctx, cancel = context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+		} else {
+			ctx, cancel = context.WithCancel(context.WithoutCancel(r.Context()))
+		}
+		rec := &responseRecorder{w: w, header: http.Header{}, code: http.StatusOK, streaming: make(chan struct{})}
+		go func() {
+			defer close(done)
+			defer cancel()
+			serveProxy(rec, r.WithContext(ctx), u, map[string]bool{u.Host: true})
+		}()
+		select {
+		case <-done:
+		case <-rec.streaming:
+			// the response belongs to the leader alone now, so does the backend request
+			context.AfterFunc(r.Context(), cancel)
+			return &coalescedResponse{streamed: true}, nil
+		}
+		cc := parseCacheControl(rec.header.Get("Cache-Control"))
+		_, noStore := cc["no-store"]
+		_, private := cc["private"]
+		shareable := rec.code == http.StatusOK && rec.header.Get("Set-Cookie") == "" && !noStore && !private
+		return &coalescedResponse{&cachedResponse{code: rec.code, header: rec.header, body: rec.body.Bytes()}, shareable, false, r.Header}, nil
+	})
+	coalesced := v.(*coalescedResponse)
+	if leader && coalesced.streamed {
+		<-done
+		return
+	}
+	if !leader && (!coalesced.shareable || !varyMatches(coalesced.res.header.Values("Vary"), coalesced.request, r.Header)) {
+		serveProxy(w, r, u, map[string]bool{u.Host: true})
+		return
+	}
+	for k, vals := range coalesced.res.header.Clone() {
+		w.Header()[k] = vals
+	}
+	if !leader {
+		setCacheStatus(r, w.Header(), "HIT")
+	}
+	w.WriteHeader(coalesced.res.code)
+	w.Write(coalesced.res.body)
+}
+
+// whether the two requests have the same values for every header named in the Vary values
+func varyMatches(vary []string, a, b http.Header) bool {
+	for _, value := range vary {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return false
+			}
+			if name != "" && strings.Join(a.Values(name), ",") != strings.Join(b.Values(name), ",") {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// a response writer keeping the response in memory up to -max-transform-size,
+// the larger responses and the event streams are streamed to the leader's writer instead .
+type responseRecorder struct {
+	w           http.ResponseWriter
+	header      http.Header
+	code        int
+	body        bytes.Buffer
+	wroteHeader bool
+	streamed    bool
+	streaming   chan struct{}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if !rec.wroteHeader {
+		rec.wroteHeader = true
+		rec.code = code
+	}
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if !rec.streamed && rec.body.Len()+len(b) > *maxTransformSize {
+		rec.stream()
+	}
+	if rec.streamed {
+		return rec.w.Write(b)
+	}
+	return rec.body.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if !rec.streamed && mediaTypeOf(rec.header) == "text/event-stream" {
+		rec.WriteHeader(http.StatusOK)
+		rec.stream()
+	}
+	if f, ok := rec.w.(http.Flusher); rec.streamed && ok {
+		f.Flush()
+	}
+}
+
+// send what has been recorded so far to the leader's writer and write through from now on
+func (rec *responseRecorder) stream() {
+	rec.streamed = true
+	for k, vals := range rec.header {
+		rec.w.Header()[k] = vals
+	}
+	rec.w.WriteHeader(rec.code)
+	rec.w.Write(rec.body.Bytes())
+	rec.body.Reset()
+	// the trailers set after the body go straight to the leader's writer
+	rec.header = rec.w.Header()
+	close(rec.streaming)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// send n identical concurrent requests through serveCoalesced, the backend holds
+// its responses back until they all have had the time to join the leader .
+func coalesceRequests(t *testing.T, backend http.HandlerFunc, requests ...*http.Request) ([]*httptest.ResponseRecorder, int64) {
+	t.Helper()
+	var hits atomic.Int64
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		backend(w, r)
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	recs := make([]*httptest.ResponseRecorder, len(requests))
+	var wg sync.WaitGroup
+	for i, r := range requests {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder, r *http.Request) {
+			defer wg.Done()
+			serveCoalesced(rec, r, u)
+		}(recs[i], r)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return recs, hits.Load()
+}
+
+func getRequests(n int, header ...string) []*http.Request {
+	requests := make([]*http.Request, n)
+	for i := range requests {
+		requests[i] = httptest.NewRequest("GET", "https://a.test/page", nil)
+		for j := 0; j+1 < len(header); j += 2 {
+			requests[i].Header.Set(header[j], header[j+1])
+		}
+	}
+	return requests
+}
+
+func TestCoalesceShared(t *testing.T) {
+	recs, hits := coalesceRequests(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "shared")
+	}, getRequests(3)...)
+	if hits != 1 {
+		t.Fatalf("%d backend requests, want 1", hits)
+	}
+	for _, rec := range recs {
+		if rec.Body.String() != "shared" {
+			t.Fatalf("got %q", rec.Body.String())
+		}
+	}
+}
+
+func TestCoalesceNotShareable(t *testing.T) {
+	recs, hits := coalesceRequests(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=1")
+		io.WriteString(w, "private")
+	}, getRequests(3)...)
+	// the leader keeps its response, only the waiters make their own request
+	if hits != 3 {
+		t.Fatalf("%d backend requests, want 3", hits)
+	}
+	for _, rec := range recs {
+		if rec.Body.String() != "private" {
+			t.Fatalf("got %q", rec.Body.String())
+		}
+	}
+}
+
+func TestCoalesceVary(t *testing.T) {
+	requests := append(getRequests(1, "Accept-Language", "en"), getRequests(1, "Accept-Language", "fr")...)
+	recs, hits := coalesceRequests(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	}, requests...)
+	if hits != 2 {
+		t.Fatalf("%d backend requests, want 2", hits)
+	}
+	for i, lang := range []string{"en", "fr"} {
+		if recs[i].Body.String() != lang {
+			t.Fatalf("the %s request got %q", lang, recs[i].Body.String())
+		}
+	}
+}
+
+func TestCoalesceLargeResponse(t *testing.T) {
+	defer func(max int) { *maxTransformSize = max }(*maxTransformSize)
+	*maxTransformSize = 8
+	body := strings.Repeat("large", 10)
+	recs, hits := coalesceRequests(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}, getRequests(3)...)
+	if hits != 3 {
+		t.Fatalf("%d backend requests, want 3", hits)
+	}
+	for _, rec := range recs {
+		if rec.Body.String() != body {
+			t.Fatalf("got %q", rec.Body.String())
+		}
+	}
+}
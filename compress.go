@@ -0,0 +1,110 @@
+package main
+
+import (
+	gz "compress/gzip"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// compress the responses by their content type,
+// when only is set just the listed types are compressed,
+// when skip is set every type except the listed ones is compressed .
+func compressTypesHandler(h http.Handler, level int, only, skip []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		cw := &compressWriter{ResponseWriter: w, level: level, only: only, skip: skip}
+		defer cw.Close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// a response writer that decides whether to compress once the headers are known
+type compressWriter struct {
+	http.ResponseWriter
+	level       int
+	only        []string
+	skip        []string
+	gz          *gz.Writer
+	wroteHeader bool
+}
+
+// whether the specified content type should be compressed
+func (cw *compressWriter) compressible(contentType string) bool {
+	mediatype, _, _ := mime.ParseMediaType(contentType)
+	if len(cw.only) > 0 {
+		return containsFold(cw.only, mediatype)
+	}
+	return !containsFold(cw.skip, mediatype)
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	hdr := cw.Header()
+	if code != http.StatusNoContent && code != http.StatusNotModified && hdr.Get("Content-Encoding") == "" && cw.compressible(hdr.Get("Content-Type")) {
+		// the body is only labelled gzip once the writer compressing it exists
+		if w, err := gz.NewWriterLevel(cw.ResponseWriter, cw.level); err == nil {
+			cw.gz = w
+			hdr.Set("Content-Encoding", "gzip")
+			hdr.Del("Content-Length")
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// flush the remaining compressed data
+func (cw *compressWriter) Close() {
+	if cw.gz != nil {
+		cw.gz.Close()
+	}
+}
+
+// whether the list contains the specified string, ignoring the case
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// split a comma separated list, dropping the empty items
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
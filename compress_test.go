@@ -0,0 +1,42 @@
+package main
+
+import (
+	gz "compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func compressRequest(level int) *httptest.ResponseRecorder {
+	h := compressTypesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "plain body")
+	}), level, nil, nil)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestCompressWriter(t *testing.T) {
+	rec := compressRequest(gz.BestCompression)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("the response wasn't compressed")
+	}
+	zr, err := gz.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != "plain body" {
+		t.Fatalf("got %q", body)
+	}
+}
+
+func TestCompressWriterInvalidLevel(t *testing.T) {
+	rec := compressRequest(42)
+	if rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "plain body" {
+		t.Fatalf("got %q labelled %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+}
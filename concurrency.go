@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync"
+)
+
+// the concurrency limiters keyed by backend address
+var (
+	backendLimitersMu sync.Mutex
+	backendLimiters   = map[string]*backendLimiter{}
+)
+
+func init() {
+	expvar.Publish("backend_concurrency", expvar.Func(func() interface{} {
+		backendLimitersMu.Lock()
+		defer backendLimitersMu.Unlock()
+		stats := map[string]map[string]int{}
+		for addr, l := range backendLimiters {
+			stats[addr] = l.stats()
+		}
+		return stats
+	}))
+}
+
+// limit the concurrent requests to a backend address shared by several domains,
+// once the limit is reached the waiting domains are served in a round robin
+// so a spike on one domain can't starve the others .
+type backendLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	active  int
+	waiting map[string][]chan struct{}
+	order   []string
+	next    int
+}
+
+// the limiter of the specified backend address, nil when there is no limit
+func limiterOf(addr string) *backendLimiter {
+	if *backendMaxConns < 1 {
+		return nil
+	}
+	backendLimitersMu.Lock()
+	defer backendLimitersMu.Unlock()
+	l, found := backendLimiters[addr]
+	if !found {
+		l = &backendLimiter{limit: *backendMaxConns, waiting: map[string][]chan struct{}{}}
+		backendLimiters[addr] = l
+	}
+	return l
+}
+
+// wait for a free slot on behalf of the specified domain
+func (l *backendLimiter) acquire(ctx context.Context, domain string) error {
+	l.mu.Lock()
+	if l.active < l.limit && len(l.order) == 0 {
+		l.active++
+		l.mu.Unlock()
+		return nil
+	}
+	ch := make(chan struct{})
+	if len(l.waiting[domain]) == 0 {
+		l.order = append(l.order, domain)
+	}
+	l.waiting[domain] = append(l.waiting[domain], ch)
+	l.mu.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		for i, c := range l.waiting[domain] {
+			if c == ch {
+				l.waiting[domain] = append(l.waiting[domain][:i], l.waiting[domain][i+1:]...)
+				if len(l.waiting[domain]) == 0 {
+					l.dropDomain(domain)
+				}
+				l.mu.Unlock()
+				return ctx.Err()
+			}
+		}
+		l.mu.Unlock()
+		// the slot was handed over meanwhile
+		l.release()
+		return ctx.Err()
+	}
+}
+
+// free a slot, handing it over to the next waiting domain if any
+func (l *backendLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.order) == 0 {
+		l.active--
+		return
+	}
+	i := l.next % len(l.order)
+	domain := l.order[i]
+	ch := l.waiting[domain][0]
+	l.waiting[domain] = l.waiting[domain][1:]
+	if len(l.waiting[domain]) == 0 {
+		l.dropDomain(domain)
+	} else {
+		l.next = i + 1
+	}
+	close(ch)
+}
+
+// remove a domain without waiters from the round robin
+func (l *backendLimiter) dropDomain(domain string) {
+	delete(l.waiting, domain)
+	for i, d := range l.order {
+		if d == domain {
+			l.order = append(l.order[:i], l.order[i+1:]...)
+			if l.next > i {
+				l.next--
+			}
+			return
+		}
+	}
+}
+
+// the active and waiting requests
+func (l *backendLimiter) stats() map[string]int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	waiting := 0
+	for _, w := range l.waiting {
+		waiting += len(w)
+	}
+	return map[string]int{"active": l.active, "waiting": waiting}
+}
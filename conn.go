@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// the backend dialer
+var dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+}
+
+// the connections rejected because their subnet is over its limit
+var subnetRejected = expvar.NewInt("subnet_connections_rejected")
+
+// a listener that applies the socket options to each accepted connection
+type tunedListener struct {
+	net.Listener
+}
+
+// accept the next connection and tune it
+func (l tunedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tuneConn(c)
+	return c, nil
+}
+
+// listen on the specified address, a failed bind is retried -bind-retry times
+// waiting -bind-retry-interval before the first retry and doubling it each time .
+func listenRetry(addr string) net.Listener {
+	interval := *bindRetryInterval
+	for attempt := 0; ; attempt++ {
+		ln, err := net.Listen("tcp", addr)
+		if err == nil {
+			return ln
+		}
+		if errors.Is(err, syscall.EADDRINUSE) {
+			err = fmt.Errorf("can't listen on %s, the address is already in use by another process", addr)
+		}
+		if attempt >= *bindRetry {
+			log.Fatal(err)
+		}
+		log.Printf("%v, retrying in %s", err, interval)
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// dial the specified backend address and tune the resulting connection
+func dialBackend(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	tuneConn(c)
+	return c, nil
+}
+
+// apply the configured socket options to the specified connection,
+// a zero buffer size keeps the os default .
+func tuneConn(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	tc.SetNoDelay(*tcpNoDelay)
+	if *sockReadBuffer > 0 {
+		tc.SetReadBuffer(*sockReadBuffer)
+	}
+	if *sockWriteBuffer > 0 {
+		tc.SetWriteBuffer(*sockWriteBuffer)
+	}
+}
+
+// count the concurrent connections per key, e.g. per client ip
+type ipCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// count a new connection of the specified key unless it already reached max,
+// a max below 1 means no limit .
+func (c *ipCounter) acquire(key string, max int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if max > 0 && c.counts[key] >= max {
+		return false
+	}
+	c.counts[key]++
+	return true
+}
+
+// forget a closed connection of the specified key
+func (c *ipCounter) release(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts[key]--; c.counts[key] < 1 {
+		delete(c.counts, key)
+	}
+}
+
+// the n keys with the most connections
+func (c *ipCounter) top(n int) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.counts))
+	for key := range c.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return c.counts[keys[i]] > c.counts[keys[j]] })
+	top := map[string]int{}
+	for _, key := range keys[:min(n, len(keys))] {
+		top[key] = c.counts[key]
+	}
+	return top
+}
+
+// the open connections of each source subnet
+var subnetConns = &ipCounter{counts: map[string]int{}}
+
+func init() {
+	expvar.Publish("subnet_connections_top", expvar.Func(func() interface{} {
+		return subnetConns.top(10)
+	}))
+}
+
+// a listener that caps the concurrent connections per source subnet
+type subnetLimitListener struct {
+	net.Listener
+	max int
+}
+
+// accept the next connection, the ones beyond the limit of their subnet are closed right away
+func (l subnetLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		subnet := subnetOf(c.RemoteAddr())
+		if !subnetConns.acquire(subnet, l.max) {
+			subnetRejected.Add(1)
+			c.Close()
+			continue
+		}
+		return &releaseConn{Conn: c, release: func() { subnetConns.release(subnet) }}, nil
+	}
+}
+
+// the source subnet of the specified address, using -subnet-prefix-v4 and -subnet-prefix-v6
+func subnetOf(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	if ip4 := tcp.IP.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(*subnetPrefixV4, 32)), Mask: net.CIDRMask(*subnetPrefixV4, 32)}).String()
+	}
+	return (&net.IPNet{IP: tcp.IP.Mask(net.CIDRMask(*subnetPrefixV6, 128)), Mask: net.CIDRMask(*subnetPrefixV6, 128)}).String()
+}
+
+// a connection that runs release once when closed
+type releaseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *releaseConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// the domains whose http/1.x connections are closed after each response, the header isn't
+// set on http/2 where it would make the server send a GOAWAY for the whole coalesced connection .
+var domain_close_connection = map[string]bool{}
+
+// parse the -close-connection flag of domains
+func parseCloseConnection(s string) {
+	for domain := range parseZones(s) {
+		domain_close_connection[domain] = true
+	}
+}
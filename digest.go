@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"hash"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// the Content-Digest algorithms
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// the Content-Digest algorithm of each domain
+var domain_digest = map[string]string{}
+
+// parse the -content-digest flag of domain[->algorithm], sha-256 by default
+func parseContentDigest(s string) {
+	for domain, algorithm := range parseZones(s) {
+		if algorithm == "" {
+			algorithm = "sha-256"
+		}
+		if _, found := digestAlgorithms[algorithm]; !found {
+			log.Fatalf("-content-digest: %s: %s, want sha-256 or sha-512", domain, algorithm)
+		}
+		domain_digest[domain] = algorithm
+	}
+}
+
+// add a Content-Digest to the responses of the configured domains and -content-digest-types,
+// it sits outside the compression so the digest is the one of the bytes actually sent .
+// the responses outgrowing -max-transform-size and the streamed ones go without .
+func digestHandler(h http.Handler) http.Handler {
+	if len(domain_digest) == 0 {
+		return h
+	}
+	types := splitList(*digestTypes)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		algorithm, found := domain_digest[hostOf(r.Host)]
+		if !found || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		bw := newBufferedWriter(w, func(code int, hdr http.Header) bool {
+			return code == http.StatusOK && hdr.Get("Content-Digest") == "" && (len(types) == 0 || containsFold(types, mediaTypeOf(hdr)))
+		})
+		h.ServeHTTP(bw, r)
+		body, ok := bw.body()
+		if !ok {
+			return
+		}
+		sum := digestAlgorithms[algorithm]()
+		sum.Write(body)
+		w.Header().Set("Content-Digest", algorithm+"=:"+base64.StdEncoding.EncodeToString(sum.Sum(nil))+":")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(bw.code)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestContentDigestHost(t *testing.T) {
+	defer func(saved map[string]string) { domain_digest = saved }(domain_digest)
+	domain_digest = map[string]string{"a.test": "sha-256"}
+	h := digestHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "body")
+	}))
+	for _, host := range []string{"a.test", "a.test:443", "A.Test"} {
+		r := httptest.NewRequest("GET", "https://a.test/", nil)
+		r.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if want := "sha-256=:Iw2DWNyOiJC0xY3utikS7i8gNXrpKlzIYbmOaP4xrLU=:"; rec.Header().Get("Content-Digest") != want {
+			t.Errorf("%s: Content-Digest %q, want %q", host, rec.Header().Get("Content-Digest"), want)
+		}
+	}
+}
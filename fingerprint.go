@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the connection context key of the ja3 fingerprint of the client hello
+type fingerprintKey struct{}
+
+// compute the ja3 fingerprint of each client hello, to log it and or pass it to the backends .
+// it is stored in the connection context before the handshake so every request of the connection carries it,
+// the http/3 connections have none .
+func enableTLSFingerprints(s *http.Server) {
+	next := s.ConnContext
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if next != nil {
+			ctx = next(ctx, c)
+		}
+		return context.WithValue(ctx, fingerprintKey{}, new(string))
+	}
+	s.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		fingerprint, ok := hello.Context().Value(fingerprintKey{}).(*string)
+		if !ok {
+			return nil, nil
+		}
+		*fingerprint = ja3(hello)
+		if *tlsFingerprintLog {
+			log.Printf("%s: %s: ja3 %s", hello.Conn.RemoteAddr(), hello.ServerName, *fingerprint)
+		}
+		return nil, nil
+	}
+}
+
+// the ja3 fingerprint of the client hello, the md5 of its version, ciphers, extensions, curves and point formats
+// without the grease values . the legacy version isn't exposed so it is 0x0303 for the tls 1.2+ clients as they all send it .
+func ja3(hello *tls.ClientHelloInfo) string {
+	version := uint16(0)
+	for _, v := range hello.SupportedVersions {
+		if !grease(v) && v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	points := make([]uint16, len(hello.SupportedPoints))
+	for i, p := range hello.SupportedPoints {
+		points[i] = uint16(p)
+	}
+	curves := make([]uint16, len(hello.SupportedCurves))
+	for i, c := range hello.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	fields := []string{strconv.Itoa(int(version)), ja3List(hello.CipherSuites), ja3List(hello.Extensions), ja3List(curves), ja3List(points)}
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+// the dash separated values without the grease ones
+func ja3List(values []uint16) string {
+	list := []string{}
+	for _, v := range values {
+		if !grease(v) {
+			list = append(list, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(list, "-")
+}
+
+// whether the value is one of the rfc 8701 grease values
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// the ja3 fingerprint of the connection of the request, empty when there is none
+func tlsFingerprint(r *http.Request) string {
+	if fingerprint, ok := r.Context().Value(fingerprintKey{}).(*string); ok {
+		return *fingerprint
+	}
+	return ""
+}
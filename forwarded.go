@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// the networks of the proxies in front of httpsify whose Forwarded header is honored
+var trustedNets []*net.IPNet
+
+// parse the -trusted-proxies flag of ips and cidrs
+func parseTrustedProxies(s string) {
+	for _, v := range splitList(s) {
+		if !strings.Contains(v, "/") {
+			if strings.Contains(v, ":") {
+				v += "/128"
+			} else {
+				v += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("-trusted-proxies: %v", err)
+		}
+		trustedNets = append(trustedNets, network)
+	}
+}
+
+// whether the specified ip belongs to a trusted proxy
+func trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range trustedNets {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse the rfc 7239 Forwarded header values into their elements
+func parseForwarded(values []string) []map[string]string {
+	elements := []map[string]string{}
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			pairs := map[string]string{}
+			for _, pair := range strings.Split(element, ";") {
+				parts := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(parts) == 2 {
+					pairs[strings.ToLower(parts[0])] = strings.Trim(parts[1], `"`)
+				}
+			}
+			elements = append(elements, pairs)
+		}
+	}
+	return elements
+}
+
+// the ip of a Forwarded node, empty when it is unknown or obfuscated
+func forwardedNodeIP(node string) string {
+	if strings.HasPrefix(node, "[") {
+		node = strings.TrimPrefix(strings.SplitN(node, "]", 2)[0], "[")
+	} else if strings.Count(node, ":") == 1 {
+		node = strings.SplitN(node, ":", 2)[0]
+	}
+	if net.ParseIP(node) == nil {
+		return ""
+	}
+	return node
+}
+
+// the Forwarded element describing the client, nil when the request didn't come
+// from a trusted proxy or carries no Forwarded header, the elements are walked from
+// the closest proxy backward skipping the ones added by trusted proxies .
+func forwardedClient(r *http.Request) map[string]string {
+	if !trustedProxy(peerIP(r)) {
+		return nil
+	}
+	elements := parseForwarded(r.Header.Values("Forwarded"))
+	for i := len(elements) - 1; i >= 0; i-- {
+		if i == 0 || !trustedProxy(forwardedNodeIP(elements[i]["for"])) {
+			return elements[i]
+		}
+	}
+	return nil
+}
+
+// the protocol the client used to reach the first proxy
+func forwardedProto(r *http.Request) string {
+	if client := forwardedClient(r); client != nil && client["proto"] != "" {
+		return strings.ToLower(client["proto"])
+	}
+	return "https"
+}
+
+// pass the Forwarded elements on to the backend with the one of the hop from the peer appended,
+// the elements sent by an untrusted peer are dropped so no client can spoof for, proto or host .
+func forwardTo(r *http.Request) {
+	forwarded := []string{}
+	if trustedProxy(peerIP(r)) {
+		forwarded = append(forwarded, r.Header.Values("Forwarded")...)
+	}
+	r.Header["Forwarded"] = append(forwarded, "for="+forwardedNode(peerIP(r))+";host="+forwardedNode(r.Host)+";proto=https")
+}
+
+// a Forwarded node, the ipv6 ones bracketed and quoted
+func forwardedNode(node string) string {
+	if strings.Contains(node, ":") {
+		return `"[` + node + `]"`
+	}
+	return node
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestForwardTo(t *testing.T) {
+	defer func(saved []*net.IPNet) { trustedNets = saved }(trustedNets)
+	trustedNets = nil
+	parseTrustedProxies("10.0.0.0/8")
+	for _, tt := range []struct {
+		peer, forwarded, want string
+	}{
+		{"192.0.2.1:1000", "for=198.51.100.1;proto=http;host=evil.test", "for=192.0.2.1;host=a.test;proto=https"},
+		{"192.0.2.1:1000", "", "for=192.0.2.1;host=a.test;proto=https"},
+		{"[2001:db8::1]:1000", "", `for="[2001:db8::1]";host=a.test;proto=https`},
+		{"10.0.0.1:1000", "for=198.51.100.1;proto=https", "for=198.51.100.1;proto=https|for=10.0.0.1;host=a.test;proto=https"},
+	} {
+		r := httptest.NewRequest("GET", "https://a.test/", nil)
+		r.Host = "a.test"
+		r.RemoteAddr = tt.peer
+		if tt.forwarded != "" {
+			r.Header.Set("Forwarded", tt.forwarded)
+		}
+		forwardTo(r)
+		if got := strings.Join(r.Header.Values("Forwarded"), "|"); got != tt.want {
+			t.Errorf("%s sending %q: forwarded %q, want %q", tt.peer, tt.forwarded, got, tt.want)
+		}
+	}
+}
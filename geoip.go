@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// the country database, nil when -geoip-db isn't set
+var geoDB *geoip2.Reader
+
+// the countries of a domain, either the only ones allowed or the ones denied
+type geoRule struct {
+	allow     bool
+	countries map[string]bool
+}
+
+// the country rule of each domain
+var domain_geo = map[string]geoRule{}
+
+// parse the -geo-block flag of domain->allow=CC|CC or domain->deny=CC|CC and open -geoip-db
+func parseGeoBlock(s string) {
+	for domain, spec := range parseZones(s) {
+		mode, list, _ := strings.Cut(spec, "=")
+		rule := geoRule{countries: map[string]bool{}}
+		switch strings.ToLower(strings.TrimSpace(mode)) {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			log.Fatalf("-geo-block: %s: want allow=CC|CC or deny=CC|CC", domain)
+		}
+		for _, country := range strings.Split(list, "|") {
+			if country = strings.TrimSpace(country); country != "" {
+				rule.countries[strings.ToUpper(country)] = true
+			}
+		}
+		domain_geo[domain] = rule
+	}
+	if len(domain_geo) == 0 {
+		return
+	}
+	if *geoipDB == "" {
+		log.Fatal("-geo-block requires -geoip-db")
+	}
+	if *geoUnknown != "allow" && *geoUnknown != "deny" {
+		log.Fatalf("-geo-unknown: %s: want allow or deny", *geoUnknown)
+	}
+	var err error
+	if geoDB, err = geoip2.Open(*geoipDB); err != nil {
+		log.Fatalf("-geoip-db: %v", err)
+	}
+}
+
+// the country code of the specified ip, empty when it is unknown
+func countryOf(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	record, err := geoDB.Country(parsed)
+	if err != nil {
+		return ""
+	}
+	return record.Country.IsoCode
+}
+
+// whether the client of the request is in a country its domain blocks,
+// the clients whose country can't be told go by -geo-unknown .
+func geoBlocked(r *http.Request) bool {
+	rule, found := domain_geo[r.Host]
+	if !found {
+		return false
+	}
+	country := countryOf(clientIP(r))
+	if country == "" {
+		return *geoUnknown == "deny"
+	}
+	return rule.countries[country] != rule.allow
+}
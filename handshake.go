@@ -0,0 +1,103 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// the connections closed before their tls handshake for going over the handshake rate
+var handshakesRejected = expvar.NewInt("handshakes_rejected")
+
+// a token bucket refilled at rate tokens per second up to burst
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take a token if there is one
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// a listener limiting the rate of new connections, hence of tls handshakes,
+// globally with -handshake-rate and per source ip with -handshake-rate-per-ip .
+// the excess connections are closed right away, before any handshake work .
+type handshakeLimitListener struct {
+	net.Listener
+	mu     sync.Mutex
+	global tokenBucket
+	perIP  map[string]*tokenBucket
+}
+
+func newHandshakeLimitListener(l net.Listener) *handshakeLimitListener {
+	hl := &handshakeLimitListener{Listener: l, perIP: map[string]*tokenBucket{}}
+	hl.global = tokenBucket{float64(*handshakeBurst), time.Now()}
+	go hl.sweep()
+	return hl
+}
+
+func (l *handshakeLimitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if !l.allow(ip) {
+			handshakesRejected.Add(1)
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
+
+// whether a new connection of the specified ip is within the rates,
+// the token of the ip is given back when the global rate turns the connection down .
+func (l *handshakeLimitListener) allow(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var b *tokenBucket
+	if *handshakeIPRate > 0 {
+		if b = l.perIP[ip]; b == nil {
+			b = &tokenBucket{float64(*handshakeIPBurst), now}
+			l.perIP[ip] = b
+		}
+		if !b.take(now, *handshakeIPRate, *handshakeIPBurst) {
+			return false
+		}
+	}
+	if *handshakeRate > 0 && !l.global.take(now, *handshakeRate, *handshakeBurst) {
+		if b != nil {
+			b.tokens++
+		}
+		return false
+	}
+	return true
+}
+
+// forget the ips whose bucket has refilled, they are back to a fresh one anyway
+func (l *handshakeLimitListener) sweep() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		l.mu.Lock()
+		for ip, b := range l.perIP {
+			if b.tokens+now.Sub(b.last).Seconds()**handshakeIPRate >= float64(*handshakeIPBurst) {
+				delete(l.perIP, ip)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHandshakeLimitRefundsIPToken(t *testing.T) {
+	defer func(rate, ipRate float64, burst, ipBurst int) {
+		*handshakeRate, *handshakeIPRate, *handshakeBurst, *handshakeIPBurst = rate, ipRate, burst, ipBurst
+	}(*handshakeRate, *handshakeIPRate, *handshakeBurst, *handshakeIPBurst)
+	*handshakeRate, *handshakeBurst = 0.001, 1
+	*handshakeIPRate, *handshakeIPBurst = 0.001, 2
+	l := &handshakeLimitListener{perIP: map[string]*tokenBucket{}, global: tokenBucket{1, time.Now()}}
+	if !l.allow("192.0.2.1") {
+		t.Fatal("the first connection was turned down")
+	}
+	for i := 0; i < 3; i++ {
+		if l.allow("192.0.2.1") {
+			t.Fatal("a connection over the global rate was let through")
+		}
+	}
+	if tokens := l.perIP["192.0.2.1"].tokens; tokens < 1 {
+		t.Fatalf("the connections the global rate turned down spent the ip's tokens, %f left", tokens)
+	}
+}
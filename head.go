@@ -0,0 +1,30 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// the domains whose backend can't handle HEAD, their HEAD requests are sent as GET
+var domain_head_as_get = map[string]bool{}
+
+// parse the -head-as-get flag of domains
+func parseHeadAsGet(s string) {
+	for domain := range parseZones(s) {
+		domain_head_as_get[domain] = true
+	}
+}
+
+// whether the request is a HEAD to send as a GET to the backend
+func headAsGet(r *http.Request) bool {
+	return r.Method == http.MethodHead && domain_head_as_get[r.Host]
+}
+
+// drop the body of the backend response to a HEAD sent as a GET,
+// its headers, Content-Length included, are those of the GET as a HEAD response should have .
+// a small body is drained so the backend connection can be reused .
+func discardBody(res *http.Response) {
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	res.Body.Close()
+	res.Body = http.NoBody
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// the exact header name spellings of each domain, keyed by the canonical name .
+// this deliberately deviates from the http spec, where header names are case
+// insensitive, to please backends that only understand their own spelling .
+var domain_header_case = map[string]map[string]string{}
+
+// parse the -header-case flag of domain->Header-Name|Other-Name
+func parseHeaderCase(s string) {
+	for domain, names := range parseZones(s) {
+		cases := map[string]string{}
+		for _, name := range strings.Split(names, "|") {
+			if name = strings.TrimSpace(name); name != "" {
+				cases[textproto.CanonicalMIMEHeaderKey(name)] = name
+			}
+		}
+		domain_header_case[domain] = cases
+	}
+}
+
+// respell the header names as configured, a nil cases map is a no-op
+func respellHeader(h http.Header, cases map[string]string) {
+	for canonical, name := range cases {
+		if v, found := h[canonical]; found && canonical != name {
+			delete(h, canonical)
+			h[name] = v
+		}
+	}
+}
+
+// a transport that respells the outgoing header names right before they are written,
+// that is after the reverse proxy has added its own headers .
+type headerCaseTransport struct {
+	http.RoundTripper
+	cases map[string]string
+}
+
+func (t headerCaseTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	respellHeader(req.Header, t.cases)
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the status codes a healthy backend answers the health check with
+var healthStatuses = map[int]bool{}
+
+// the redirects the backends answer the health checks with are answers of their own
+func healthRedirect(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+// start checking the health of every pooled backend when -health-http-path is set
+func startHealthChecks() {
+	if *healthPath == "" {
+		return
+	}
+	for _, code := range splitList(*healthExpectStatus) {
+		status, err := strconv.Atoi(code)
+		if err != nil {
+			log.Fatalf("-health-expect-status: %s: %v", code, err)
+		}
+		healthStatuses[status] = true
+	}
+	for domain, pool := range domain_pool {
+		for _, u := range pool.upstreams {
+			go watchHealth(domain, u)
+		}
+	}
+}
+
+// check the backend every -health-interval, taking it out of the pool
+// while the check fails and back in once it passes again .
+func watchHealth(domain string, u *upstream) {
+	for {
+		if err := checkHealth(domain, u.url); err != nil {
+			if !u.down.Swap(true) {
+				log.Printf("%s: backend %s is down: %v", domain, u.url, err)
+			}
+		} else if u.down.Swap(false) {
+			log.Printf("%s: backend %s is back up", domain, u.url)
+		}
+		time.Sleep(*healthInterval)
+	}
+}
+
+// send the health check request to the backend of the specified domain
+func checkHealth(domain, backend string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, *healthMethod, backend+"/"+strings.TrimLeft(*healthPath, "/"), nil)
+	if err != nil {
+		return err
+	}
+	req.Host = domain
+	// the checks go through the transport of the domain, so through its forward proxy if any
+	client := &http.Client{Transport: transportOf(domain), CheckRedirect: healthRedirect}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if !healthStatuses[res.StatusCode] {
+		return &healthError{"unexpected status " + res.Status}
+	}
+	if *healthExpectBody != "" {
+		body, err := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), *healthExpectBody) {
+			return &healthError{"body lacks " + strconv.Quote(*healthExpectBody)}
+		}
+	}
+	return nil
+}
+
+// a health check that got an answer, only the wrong one
+type healthError struct {
+	reason string
+}
+
+func (e *healthError) Error() string {
+	return e.reason
+}
+
+// report the health of the pooled backends of each domain
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := map[string]map[string]string{}
+	for domain, pool := range domain_pool {
+		health[domain] = map[string]string{}
+		for _, u := range pool.upstreams {
+			state := "up"
+			if u.down.Load() {
+				state = "down"
+			}
+			health[domain][u.url] = state
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// the domains whose subdomains are served by their backend and get certificates too
+var baseDomains []string
+
+// our addresses a subdomain must resolve to with -cert-dns-confirm
+var ownIPs = map[string]bool{}
+
+// parse the -cert-base-domains flag of domains, each must be one of -domains,
+// and the -cert-dns-ips flag, which defaults to the addresses of the local interfaces .
+func parseBaseDomains(s string) {
+	for domain := range parseZones(s) {
+		if _, found := domain_backend[domain]; !found {
+			log.Fatalf("-cert-base-domains: %s isn't one of -domains", domain)
+		}
+		baseDomains = append(baseDomains, domain)
+	}
+	if !*certDNSConfirm {
+		return
+	}
+	for _, ip := range splitList(*certDNSIPs) {
+		if parsed := net.ParseIP(ip); parsed != nil {
+			ownIPs[parsed.String()] = true
+		} else {
+			log.Fatalf("-cert-dns-ips: %s: invalid ip", ip)
+		}
+	}
+	if len(ownIPs) > 0 {
+		return
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Fatalf("-cert-dns-confirm: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			ownIPs[ipnet.IP.String()] = true
+		}
+	}
+}
+
+// the base domain the specified host is a subdomain of, empty when there is none
+func baseDomainOf(host string) string {
+	for _, base := range baseDomains {
+		if strings.HasSuffix(host, "."+base) {
+			return base
+		}
+	}
+	return ""
+}
+
+// allow the certificates of the whitelisted hosts and of the subdomains of the base domains,
+// with -cert-dns-confirm a subdomain must resolve to one of our addresses first so nobody
+// can get us to request certificates for names pointing elsewhere .
+func hostPolicy(whitelisted []string) autocert.HostPolicy {
+	whitelist := autocert.HostWhitelist(whitelisted...)
+	return func(ctx context.Context, host string) error {
+		if err := whitelist(ctx, host); err == nil || baseDomainOf(host) == "" {
+			return err
+		}
+		if !*certDNSConfirm {
+			return nil
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("acme/autocert: %s: %v", host, err)
+		}
+		for _, addr := range addrs {
+			if ownIPs[addr.IP.String()] {
+				return nil
+			}
+		}
+		return fmt.Errorf("acme/autocert: %s doesn't resolve to this host", host)
+	}
+}
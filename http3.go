@@ -0,0 +1,30 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// serve http/3 over udp on the listen address alongside the tcp listener,
+// it shares the certificates and the whole middleware chain, the returned
+// handler advertises it to the http/1.1 and http/2 clients via Alt-Svc .
+func serveHTTP3(h http.Handler, tlsConfig *tls.Config) http.Handler {
+	h3 := &http3.Server{
+		Addr:      *listen,
+		Handler:   h,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig.Clone()),
+	}
+	conn := listenPacketUpgradable("http3", *listen)
+	go func() {
+		log.Fatal(h3.Serve(conn))
+	}()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			h3.SetQUICHeaders(w.Header())
+		}
+		h.ServeHTTP(w, r)
+	})
+}
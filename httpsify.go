@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
@@ -12,6 +15,7 @@ import (
 	"net/url"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/gorilla/handlers"
 	"github.com/tdewolff/minify"
@@ -21,26 +25,163 @@ import (
 	"github.com/tdewolff/minify/json"
 	"github.com/tdewolff/minify/svg"
 	"github.com/tdewolff/minify/xml"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
 	// CMD options
-	listen      = flag.String("listen", ":443", "the local listen address")
-	domains     = flag.String("domains", "", "a comma separated strings of domain[->[ip]:port]")
-	backend     = flag.String("backend", ":80", "the default backend to be used")
-	sslCacheDir = flag.String("ssl-cache-dir", "./httpsify-ssl-cache", "the cache directory to cache generated ssl certs")
-	gzip        = flag.Int("gzip", 0, "gzip compression level [0-9]")
-	mnfy        = flag.Bool("minify", true, "whether to minify the output or not")
+	listen             = flag.String("listen", ":443", "the local listen address")
+	domains            = flag.String("domains", "", "a comma separated strings of domain[->[ip]:port], domain->[ip]:port[@weight]|[ip]:port[@weight] or domain->srv:<record>")
+	backend            = flag.String("backend", ":80", "the default backend to be used")
+	sslCacheDir        = flag.String("ssl-cache-dir", "./httpsify-ssl-cache", "the cache directory to cache generated ssl certs")
+	certBaseDomains    = flag.String("cert-base-domains", "", "a comma separated list of -domains whose subdomains are served by the same backend and get certificates too")
+	certDNSConfirm     = flag.Bool("cert-dns-confirm", false, "only request the certificate of a -cert-base-domains subdomain once it resolves to -cert-dns-ips")
+	certDNSIPs         = flag.String("cert-dns-ips", "", "a comma separated list of our public ips for -cert-dns-confirm, the local interface addresses by default")
+	gzip               = flag.Int("gzip", 0, "gzip compression level [0-9]")
+	compressOnly       = flag.String("compress-only-types", "", "a comma separated list of the only content types to compress, can't be used with -compress-skip-types")
+	compressSkip       = flag.String("compress-skip-types", "", "a comma separated list of content types to never compress, can't be used with -compress-only-types")
+	mnfy               = flag.Bool("minify", true, "whether to minify the output or not")
+	minifyInline       = flag.Bool("minify-inline", true, "whether to minify the inline css, js and json (e.g. ld+json) blocks of the html responses as well")
+	minifyCacheSize    = flag.Int("minify-cache-size", 0, "how many minified responses to cache so identical responses are minified once, 0 disables the cache")
+	minifyCacheBytes   = flag.Int64("minify-cache-bytes", 64<<20, "the max total size in bytes of the cached minified responses, 0 means no limit")
+	staleCacheSize     = flag.Int("stale-cache-size", 0, "how many backend responses to keep to be served stale when the backend fails, 0 disables it")
+	staleCacheBytes    = flag.Int64("stale-cache-bytes", 64<<20, "the max total size in bytes of the responses kept to be served stale, 0 means no limit")
+	staleIfError       = flag.Duration("stale-if-error", 0, "how long past its max-age a response may be served stale when it has no stale-if-error directive")
+	cacheKeys          = flag.String("cache-key", "", "a comma separated strings of domain[/path-prefix]->header:Name|cookie:name added to the cache key")
+	cacheStatusHeader  = flag.String("cache-status-header", "", "the response header telling HIT, MISS, STALE or BYPASS when caching is active, e.g. X-Cache, empty disables it")
+	maxTransformSize   = flag.Int("max-transform-size", 10<<20, "the max response size in bytes held back in memory to be minified or transformed")
+	tcpNoDelay         = flag.Bool("tcp-nodelay", true, "whether to disable nagle's algorithm on the client and backend connections")
+	sockReadBuffer     = flag.Int("sock-read-buffer", 0, "the socket read buffer size in bytes of the client and backend connections, 0 means the os default")
+	sockWriteBuffer    = flag.Int("sock-write-buffer", 0, "the socket write buffer size in bytes of the client and backend connections, 0 means the os default")
+	redirects          = flag.String("redirects", "", "a comma separated strings of domain->target-domain to permanently redirect, e.g. www.example.org->example.org")
+	hsts               = flag.String("hsts", "", "the Strict-Transport-Security header value to send, e.g. \"max-age=63072000; includeSubDomains; preload\", empty disables it")
+	timeouts           = flag.String("timeouts", "", "a comma separated strings of domain[/path-prefix]->timeout, e.g. example.org/reports->60s,example.org->2s")
+	nel                = flag.String("nel", "", "a comma separated strings of domain[->collector-url] to send network error logging headers for")
+	nelReportPath      = flag.String("nel-report-path", "", "the path of the built-in nel report endpoint used by the domains without a collector, e.g. /.well-known/nel")
+	bindRetry          = flag.Int("bind-retry", 0, "how many times to retry listening when the listen address can't be bound")
+	bindRetryInterval  = flag.Duration("bind-retry-interval", time.Second, "the wait before the first bind retry, it doubles after each retry")
+	backendMaxConns    = flag.Int("backend-max-conns", 0, "the max concurrent requests per backend address shared fairly by its domains, 0 means no limit")
+	headerCase         = flag.String("header-case", "", "a comma separated strings of domain->Header-Name|Other-Name to send to the backend spelled exactly as given")
+	wsMaxPerIP         = flag.Int("ws-max-per-ip", 0, "the max concurrent websocket connections per client ip, 0 means no limit")
+	inject             = flag.String("inject", "", "a comma separated strings of domain[->percent] of the text responses to inject -inject-content into, 100% by default")
+	injectMarker       = flag.String("inject-marker", "</head>", "the marker -inject-content is inserted at, matched case insensitively")
+	injectContent      = flag.String("inject-content", "", "the content to inject, e.g. a <script> tag")
+	injectAfter        = flag.Bool("inject-after", false, "whether to inject after the marker instead of before it")
+	trustedProxies     = flag.String("trusted-proxies", "", "a comma separated list of ips/cidrs of the proxies in front of httpsify whose Forwarded header is honored")
+	methodRoutes       = flag.String("method-routes", "", "a comma separated strings of domain->read=[ip]:port|write=[ip]:port|METHOD=[ip]:port, unmatched methods use the domain backend")
+	alpnRoutes         = flag.String("alpn-routes", "", "a comma separated strings of domain->h2=[ip]:port|http/1.1=[ip]:port routing on the negotiated alpn protocol")
+	langRoutes         = flag.String("lang-routes", "", "a comma separated strings of domain->en=[ip]:port|ja=[ip]:port|default=[ip]:port routing on the Accept-Language preferences")
+	methodOverride     = flag.String("method-override", "", "a comma separated list of domains whose POST requests may carry another method in X-HTTP-Method-Override")
+	overrideQuery      = flag.Bool("method-override-query", false, "also honor the _method query parameter on the -method-override domains")
+	enableHTTP3        = flag.Bool("http3", false, "whether to serve http/3 (quic) on udp alongside tcp, the udp listen port must be reachable")
+	connLimitSubnet    = flag.Int("conn-limit-per-subnet", 0, "the max concurrent client connections per source subnet, 0 means no limit")
+	subnetPrefixV4     = flag.Int("subnet-prefix-v4", 24, "the prefix length grouping the ipv4 clients of -conn-limit-per-subnet")
+	subnetPrefixV6     = flag.Int("subnet-prefix-v6", 64, "the prefix length grouping the ipv6 clients of -conn-limit-per-subnet")
+	upgradeAllow       = flag.String("upgrade-allow", "", "a comma separated strings of domain->protocol|protocol of the allowed Upgrade protocols, websocket only by default")
+	otlpEndpoint       = flag.String("otlp-endpoint", "", "the otlp/http collector to export a span per request to, e.g. http://localhost:4318, empty disables it")
+	lbStrategy         = flag.String("lb-strategy", "round-robin", "how a domain with several backends picks one, round-robin or weighted-random")
+	healthPath         = flag.String("health-http-path", "", "the path the pooled backends are health checked on, empty disables the health checks")
+	healthMethod       = flag.String("health-method", http.MethodGet, "the method of the health check requests")
+	healthExpectStatus = flag.String("health-expect-status", "200", "a comma separated list of the status codes of a healthy backend")
+	healthExpectBody   = flag.String("health-expect-body", "", "a substring the body of a healthy backend response must contain")
+	healthInterval     = flag.Duration("health-interval", 10*time.Second, "how often the pooled backends are health checked")
+	healthTimeout      = flag.Duration("health-timeout", 5*time.Second, "how long a health check may take")
+	rateLimitMax       = flag.Int("rate-limit", 0, "the max requests per client ip within -rate-window, 0 means no limit")
+	rateWindow         = flag.Duration("rate-window", time.Minute, "the window of -rate-limit and -tarpit-threshold")
+	rateLimitResponses = flag.String("rate-limit-responses", "", "a json file of domain: {status, content_type, headers, body} custom rate limited responses, the body may use {{.RetryAfter}}")
+	tarpitThreshold    = flag.Int("tarpit-threshold", 0, "the requests per client ip within -rate-window beyond which the client gets tarpitted, 0 disables it")
+	tarpitDelay        = flag.Duration("tarpit-delay", 30*time.Second, "how long a tarpitted request waits before its 429")
+	tarpitMax          = flag.Int("tarpit-max", 100, "the max requests tarpitted at once, the extra ones are disconnected")
+	wsWriteTimeout     = flag.String("ws-write-timeout", "", "a comma separated strings of domain->timeout after which a websocket peer that doesn't keep up with the other side gets disconnected, the other side gets a 1008 close frame")
+	wsReadIdle         = flag.String("ws-read-idle", "", "a comma separated strings of domain->timeout after which a websocket with no traffic either way is closed, reported as its client being idle")
+	wsWriteIdle        = flag.String("ws-write-idle", "", "a comma separated strings of domain->timeout after which a websocket with no traffic either way is closed, reported as its backend being idle")
+	wsDialRetries      = flag.Int("ws-dial-retries", 0, "how many times a websocket backend that can't be reached is dialed again before the upgrade fails")
+	wsRetryInterval    = flag.Duration("ws-dial-retry-interval", 100*time.Millisecond, "the pause before the first -ws-dial-retries retry, doubled after each one")
+	shutdownTimeout    = flag.Duration("shutdown-timeout", 30*time.Second, "how long the in flight requests get to finish on SIGTERM or SIGINT")
+	wsDrainPolicy      = flag.String("ws-drain-policy", "force", "what happens to the websockets on shutdown, force closes them, wait lets them close on their own and notify asks the clients to reconnect")
+	wsDrainTimeout     = flag.Duration("ws-drain-timeout", 10*time.Second, "how long the websockets get to close on shutdown with the wait and notify -ws-drain-policy")
+	relativeLinks      = flag.String("relative-links", "", "a comma separated strings of domain->host|host whose absolute html links get rewritten as root relative links")
+	contentDigest      = flag.String("content-digest", "", "a comma separated strings of domain[->sha-256|sha-512] whose responses get a Content-Digest")
+	digestTypes        = flag.String("content-digest-types", "", "a comma separated list of the content types getting a -content-digest, empty means all")
+	stripScripts       = flag.String("strip-scripts", "", "a comma separated strings of domain->regexp|regexp of the script srcs or inline scripts stripped from html responses")
+	jsonRewrites       = flag.String("json-rewrite", "", "a comma separated strings of domain[/path-prefix]->old=new|-removed|+added=value rewriting the fields of json responses")
+	jsonReqRewrites    = flag.String("json-request-rewrite", "", "a comma separated strings of domain[/path-prefix]->old=new|-removed|+added=value rewriting the fields of json request bodies")
+	canaries           = flag.String("canary", "", "a comma separated strings of domain:percent%->[ip]:port sending a share of the traffic to a canary backend")
+	canaryWindow       = flag.Duration("canary-window", time.Minute, "the window over which the canary error rate is measured")
+	canaryMaxErrorRate = flag.Float64("canary-max-error-rate", 5, "the 5xx rate in percent of a canary above which its traffic is rolled back")
+	canaryMinRequests  = flag.Int("canary-min-requests", 20, "the min requests in a window before a canary may be rolled back")
+	totalEgressRate    = flag.Int("total-egress-rate", 0, "the total egress bytes per second shared fairly by the connections writing at the same time, 0 means no limit")
+	viaProxy           = flag.String("backend-via-proxy", "", "a comma separated strings of domain->http://[user:pass@]proxy:port to reach the domain backends through an http CONNECT tunnel")
+	connectTimeout     = flag.Duration("connect-timeout", 30*time.Second, "how long to wait for a backend connection, a failure fails over to the other backends of the domain")
+	firstByteTimeout   = flag.Duration("first-byte-timeout", 0, "how long to wait for the backend response headers once the request is sent, a failure is a 504 without fail over, 0 means no timeout")
+	coalesce           = flag.String("coalesce", "", "a comma separated list of domains whose identical concurrent anonymous GETs share a single backend request")
+	defaultCharset     = flag.String("default-charset", "", "a comma separated strings of domain[->charset] whose text responses without a charset get one, utf-8 by default")
+	maxConcurrent      = flag.Int("max-concurrent", 0, "the max requests served at once, 0 means no limit")
+	qos                = flag.String("qos", "", "a comma separated strings of path:/prefix, method:METHOD or header:Name[=substring] -> low|normal|high request tiers")
+	qosLowThreshold    = flag.Int("qos-low-threshold", 70, "the percent of -max-concurrent past which the low tier requests are shed")
+	qosNormalThreshold = flag.Int("qos-normal-threshold", 90, "the percent of -max-concurrent past which the normal tier requests are shed")
+	bandwidthQuotas    = flag.String("bandwidth-quota", "", "a comma separated strings of domain->size e.g. 500G of the egress allowed per -bandwidth-period")
+	bandwidthPeriod    = flag.String("bandwidth-period", "monthly", "the period the bandwidth quotas are reset at, monthly or daily")
+	bandwidthAction    = flag.String("bandwidth-action", "block", "what happens once a domain used up its quota, block answers 509 and throttle slows it to -bandwidth-throttle-rate")
+	bandwidthThrottle  = flag.Int("bandwidth-throttle-rate", 64<<10, "the bytes per second a response of a domain over its quota is sent at with -bandwidth-action throttle")
+	bandwidthState     = flag.String("bandwidth-state", "", "the file the bandwidth usage is saved to every minute so it survives restarts")
+	requiredHeaderList = flag.String("required-headers", "", "a comma separated strings of domain->Name|Name[|status=code] of the request headers a domain requires")
+	requiredStatus     = flag.Int("required-headers-status", http.StatusBadRequest, "the status code answered to the requests lacking a -required-headers header")
+	closeConnection    = flag.String("close-connection", "", "a comma separated list of domains whose http/1.x connections are closed after each response")
+	headAsGetDomains   = flag.String("head-as-get", "", "a comma separated list of domains whose HEAD requests are sent as GET to the backend, the body is dropped")
+	idempotency        = flag.String("idempotency", "", "a comma separated strings of domain[/path-prefix]->METHOD|METHOD whose Idempotency-Key requests get their response replayed, POST by default")
+	idempotencyTTL     = flag.Duration("idempotency-ttl", 24*time.Hour, "how long the response to an Idempotency-Key is replayed")
+	idempotencySize    = flag.Int("idempotency-size", 10000, "the max number of Idempotency-Key responses kept")
+	idempotencyBytes   = flag.Int64("idempotency-bytes", 64<<20, "the max total size in bytes of the Idempotency-Key responses kept, 0 means no limit")
+	uaRulesFile        = flag.String("ua-rules", "", "a file of \"<domain|*> <allow|deny> <regexp>\" user agent rules, reloaded on SIGHUP")
+	uaBlockStatus      = flag.Int("ua-block-status", http.StatusForbidden, "the status code answered to the blocked user agents")
+	uaBlockBody        = flag.String("ua-block-body", "forbidden", "the body answered to the blocked user agents")
+	geoipDB            = flag.String("geoip-db", "", "the MaxMind format country database used by -geo-block")
+	geoBlock           = flag.String("geo-block", "", "a comma separated strings of domain->allow=CC|CC or domain->deny=CC|CC of client countries")
+	geoBlockStatus     = flag.Int("geo-block-status", http.StatusUnavailableForLegalReasons, "the status code answered to the clients of blocked countries")
+	geoUnknown         = flag.String("geo-unknown", "allow", "whether the clients whose country is unknown are allowed or denied")
+	tlsFingerprintLog  = flag.Bool("tls-fingerprint-log", false, "log the ja3 fingerprint of the tls client hello of each connection")
+	tlsFingerprintHdr  = flag.Bool("tls-fingerprint-header", false, "send the ja3 fingerprint of the client connection to the backends in X-Tls-Fingerprint")
+	handshakeRate      = flag.Float64("handshake-rate", 0, "the max new tls connections per second, 0 means no limit")
+	handshakeBurst     = flag.Int("handshake-burst", 100, "the new tls connections allowed at once over -handshake-rate")
+	handshakeIPRate    = flag.Float64("handshake-rate-per-ip", 0, "the max new tls connections per second of each client ip, 0 means no limit")
+	handshakeIPBurst   = flag.Int("handshake-burst-per-ip", 10, "the new tls connections of a client ip allowed at once over -handshake-rate-per-ip")
+	readHeaderTimeout  = flag.Duration("read-header-timeout", 0, "how long a client may take to send the request headers, 0 means no timeout")
+	minReadRate        = flag.Int("min-read-rate", 0, "the min bytes per second a client must send its request at once -min-read-rate-grace has passed, 0 disables it")
+	minReadRateGrace   = flag.Duration("min-read-rate-grace", 5*time.Second, "how long a request may be read before -min-read-rate is enforced")
+	srvInterval        = flag.Duration("srv-interval", 30*time.Second, "how often the srv:<record> backends are re-resolved")
+	adminListen        = flag.String("admin-listen", "", "the admin listen address serving /config and /debug/vars, empty disables it")
+	adminToken         = flag.String("admin-token", "", "the bearer token required by the admin endpoints, mandatory unless -admin-listen is a loopback address")
+	logFile            = flag.String("log-file", "", "the file the log and the access log are written to, empty means stderr")
+	logMaxSize         = flag.Int("log-max-size", 100, "the size in megabytes at which -log-file is rotated, 0 disables the rotation")
+	logMaxAge          = flag.Duration("log-max-age", 0, "how long the rotated log files are kept, 0 keeps them forever")
+	logMaxBackups      = flag.Int("log-max-backups", 0, "how many rotated log files are kept, 0 keeps them all")
+	logCompress        = flag.Bool("log-compress", false, "gzip the rotated log files")
+	accessLog          = flag.Bool("access-log", false, "log every request in the combined log format")
+	auditLog           = flag.String("audit-log", "", "the file the admin changes and the reloads are audited to as json lines, empty disables the audit")
 
 	// internal vars
-	domain_backend = map[string]string{}
-	whitelisted    = []string{}
+	domain_backend  = map[string]string{}
+	domain_redirect = map[string]string{}
+	domain_srv      = map[string]*srvBackend{}
+	whitelisted     = []string{}
+	transport       = http.DefaultTransport.(*http.Transport).Clone()
+
+	// metrics
+	backendEmptyResponses = expvar.NewInt("backend_empty_responses")
+	backendErrors         = expvar.NewInt("backend_errors")
+	backendTimeouts       = expvar.NewInt("backend_timeouts")
+	backendConnectErrors  = expvar.NewInt("backend_connect_errors")
+	clientCancelled       = expvar.NewInt("client_cancelled_requests")
 )
 
 func main() {
 	flag.Parse()
 
+	accessLogOut := setupLog()
+	openAuditLog()
+
 	if *domains == "" {
 		flag.Usage()
 		fmt.Println(`Example(template): httpsify -domains "example.org,api.example.org->localhost:366, api2.example.org->:367"`)
@@ -49,21 +190,111 @@ func main() {
 		return
 	}
 
+	if *gzip < 0 || *gzip > 9 {
+		log.Fatalf("-gzip %d: the compression level must be in [0-9]", *gzip)
+	}
+
+	if *compressOnly != "" && *compressSkip != "" {
+		log.Fatal("-compress-only-types and -compress-skip-types are mutually exclusive, please set only one of them")
+	}
+
+	if *wsDrainPolicy != "force" && *wsDrainPolicy != "wait" && *wsDrainPolicy != "notify" {
+		log.Fatalf("-ws-drain-policy: %s: want force, wait or notify", *wsDrainPolicy)
+	}
+	if *lbStrategy != "round-robin" && *lbStrategy != "weighted-random" {
+		log.Fatalf("-lb-strategy %s: unknown strategy, please use round-robin or weighted-random", *lbStrategy)
+	}
+
+	if *adminListen != "" && *adminToken == "" && !isLoopback(*adminListen) {
+		log.Fatalf("-admin-listen %s isn't a loopback address, please set -admin-token", *adminListen)
+	}
+
 	for _, zone := range strings.Split(*domains, ",") {
 		parts := strings.SplitN(zone, "->", 2)
 		if len(parts) < 2 {
 			parts = append(parts, *backend)
 		}
-		parts[1] = fixUrl(parts[1])
-		domain_backend[parts[0]] = parts[1]
+		if name := strings.TrimSpace(parts[1]); strings.HasPrefix(name, "srv:") {
+			domain_srv[parts[0]] = newSrvBackend(strings.TrimPrefix(name, "srv:"))
+		}
+		if strings.Contains(parts[1], "|") {
+			domain_pool[parts[0]] = parsePool(parts[1])
+			domain_backend[parts[0]] = strings.TrimSpace(parts[1])
+		} else {
+			// the weight of a lone backend doesn't weigh anything
+			backend, _ := splitWeight(parts[1])
+			domain_backend[parts[0]] = fixUrl(backend)
+		}
 		whitelisted = append(whitelisted, parts[0])
 	}
 
+	for domain, target := range parseZones(*redirects) {
+		domain_redirect[domain] = strings.TrimPrefix(target, "https://")
+		whitelisted = append(whitelisted, domain)
+	}
+
+	parseBaseDomains(*certBaseDomains)
+	parseTrustedProxies(*trustedProxies)
+	parseTimeouts(*timeouts)
+	if *staleCacheSize > 0 {
+		staleCache = newLRU(*staleCacheSize, *staleCacheBytes)
+	}
+	parseNel(*nel)
+	parseHeaderCase(*headerCase)
+	parseMethodRoutes(*methodRoutes)
+	parseALPNRoutes(*alpnRoutes)
+	parseLangRoutes(*langRoutes)
+	parseMethodOverride(*methodOverride)
+	parseUpgradeAllow(*upgradeAllow)
+	parseWsWriteTimeouts(*wsWriteTimeout)
+	parseWsIdleTimeouts("ws-read-idle", *wsReadIdle, domain_ws_read_idle)
+	parseWsIdleTimeouts("ws-write-idle", *wsWriteIdle, domain_ws_write_idle)
+	parseViaProxies(*viaProxy)
+	parseCacheKeys(*cacheKeys)
+	parseCoalesce(*coalesce)
+	parseHeadAsGet(*headAsGetDomains)
+	parseCloseConnection(*closeConnection)
+	parseRequiredHeaders(*requiredHeaderList)
+	parseBandwidthQuotas(*bandwidthQuotas)
+	parseQoS(*qos)
+	parseDefaultCharset(*defaultCharset)
+	parseIdempotency(*idempotency)
+	loadRateLimitResponses()
+	if err := loadUARules(); err != nil {
+		log.Fatal(err)
+	}
+	reloaders = append(reloaders, reloader{"ua-rules", loadUARules, uaRulesState})
+	go watchReload()
+	parseInject(*inject)
+	parseRelativeLinks(*relativeLinks)
+	parseStripScripts(*stripScripts)
+	parseContentDigest(*contentDigest)
+	parseJSONRewrites(*jsonRewrites)
+	parseJSONRequestRewrites(*jsonReqRewrites)
+	parseCanaries(*canaries)
+	parseGeoBlock(*geoBlock)
+
+	dialer.Timeout = *connectTimeout
+	transport.DialContext = dialBackend
+	transport.ResponseHeaderTimeout = *firstByteTimeout
+	setupViaProxies()
+	startHealthChecks()
+
 	minifier := minify.New()
 
 	if *mnfy {
+		// the html minifier hands the inline <style> and <script> blocks and the style attributes
+		// over to the minifier of their type, e.g. application/ld+json goes to the json one .
+		htmlMinifier := &html.Minifier{}
 		minifier.AddFunc("text/css", css.Minify)
-		minifier.AddFunc("text/html", html.Minify)
+		if *minifyInline {
+			minifier.Add("text/html", htmlMinifier)
+		} else {
+			// an empty minifier has nothing to hand the inline blocks over to
+			minifier.AddFunc("text/html", func(_ *minify.M, w io.Writer, r io.Reader, params map[string]string) error {
+				return htmlMinifier.Minify(minify.New(), w, r, params)
+			})
+		}
 		minifier.AddFunc("image/svg+xml", svg.Minify)
 		minifier.AddFuncRegexp(regexp.MustCompile("[/+]javascript$"), js.Minify)
 		minifier.AddFuncRegexp(regexp.MustCompile("[/+]json$"), json.Minify)
@@ -72,22 +303,91 @@ func main() {
 
 	m := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(whitelisted...),
+		HostPolicy: hostPolicy(whitelisted),
 		Cache:      autocert.DirCache(*sslCacheDir),
 	}
 
-	h := handlers.CompressHandlerLevel(
-		minifier.Middleware(handler()),
-		*gzip,
-	)
+	certManager = &m
+	go loadCertExpiry(m.Cache, whitelisted)
+
+	proxied := transformHandler(handler())
+	h := minifier.Middleware(proxied)
+	if *mnfy && *minifyCacheSize > 0 {
+		h = minifyCacheHandler(minifier, newLRU(*minifyCacheSize, *minifyCacheBytes), proxied)
+	}
+
+	if *compressOnly != "" || *compressSkip != "" {
+		h = compressTypesHandler(
+			h,
+			*gzip,
+			splitList(*compressOnly),
+			splitList(*compressSkip),
+		)
+	} else {
+		h = handlers.CompressHandlerLevel(
+			h,
+			*gzip,
+		)
+	}
+
+	h = digestHandler(h)
+	h = bandwidthHandler(h)
+
+	if *accessLog {
+		h = handlers.CombinedLoggingHandler(accessLogOut, h)
+	}
+
+	if *otlpEndpoint != "" {
+		h = otlpHandler(h)
+	}
+
+	// acme-tls/1 must be offered for the tls-alpn-01 challenges to reach autocert
+	tlsConfig := &tls.Config{
+		GetCertificate: trackCertificates(m.GetCertificate),
+		NextProtos:     []string{"h2", "http/1.1", acme.ALPNProto},
+	}
+
+	if *enableHTTP3 {
+		h = serveHTTP3(h, tlsConfig)
+	}
 
 	s := &http.Server{
-		Addr:      *listen,
-		Handler:   h,
-		TLSConfig: &tls.Config{GetCertificate: m.GetCertificate},
+		Addr:              *listen,
+		Handler:           h,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: *readHeaderTimeout,
+	}
+
+	if *adminListen != "" {
+		go serveAdmin()
+	}
+
+	var ln net.Listener = tunedListener{listenUpgradable("listen", *listen, listenRetry)}
+	if *totalEgressRate > 0 {
+		ln = pacedListener{ln}
+	}
+	if *connLimitSubnet > 0 {
+		ln = subnetLimitListener{ln, *connLimitSubnet}
+	}
+	if *handshakeRate > 0 || *handshakeIPRate > 0 {
+		ln = newHandshakeLimitListener(ln)
+	}
+	if *minReadRate > 0 {
+		ln = minRateListener{ln}
+		enforceMinReadRate(s)
+	}
+	if *tlsFingerprintLog || *tlsFingerprintHdr {
+		enableTLSFingerprints(s)
 	}
 
-	log.Fatal(s.ListenAndServeTLS("", ""))
+	drained := make(chan struct{})
+	go shutdownOnSignal(s, drained)
+	go watchUpgrade()
+	upgradeReady()
+	if err := s.ServeTLS(ln, "", ""); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-drained
 }
 
 // fix the specified url
@@ -105,38 +405,396 @@ func fixUrl(u string) string {
 	return u
 }
 
+// parse a comma separated strings of domain[->value] into a map
+func parseZones(s string) map[string]string {
+	zones := map[string]string{}
+	for _, zone := range strings.Split(s, ",") {
+		parts := strings.SplitN(zone, "->", 2)
+		if strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+		if len(parts) < 2 {
+			parts = append(parts, "")
+		}
+		zones[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return zones
+}
+
+// the host of the specified Host header value without its port and lowercased, an ipv6 literal loses
+// its brackets while anything else between brackets is kept so it stays an invalid hostname .
+func hostOf(hostport string) string {
+	hostport = strings.ToLower(hostport)
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	} else if strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]") {
+		host = hostport[1 : len(hostport)-1]
+	}
+	if strings.HasPrefix(hostport, "[") && net.ParseIP(host) == nil {
+		return hostport
+	}
+	return host
+}
+
+// whether the specified host is a valid dns hostname or an ip address
+func validHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// the ip address of the connected peer
+func peerIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// the ip address of the client,
+// behind a trusted proxy it is taken from the Forwarded header .
+func clientIP(r *http.Request) string {
+	if client := forwardedClient(r); client != nil {
+		if ip := forwardedNodeIP(client["for"]); ip != "" {
+			return ip
+		}
+	}
+	return peerIP(r)
+}
+
+// whether the request protocol isn't an unknown HTTP/1 minor version, net/http already
+// answers 505 to the other major versions and 400 to the malformed ones, but lets HTTP/1.2 to 1.9 through .
+func supportedProto(r *http.Request) bool {
+	return r.ProtoMajor != 1 || r.ProtoMinor <= 1
+}
+
+// the domain whose backends serve the specified host, that is its base domain
+// when it is a subdomain of one of -cert-base-domains without a backend of its own .
+func configuredDomain(host string) string {
+	if _, found := domain_backend[host]; !found {
+		if base := baseDomainOf(host); base != "" {
+			return base
+		}
+	}
+	return host
+}
+
+// the backend base url of the specified request,
+// it is empty when the domain is discovered via srv and nothing has been resolved yet,
+// or when every backend of its pool is down .
+func backendOf(r *http.Request) string {
+	if backend := methodBackend(r); backend != "" {
+		return backend
+	}
+	if backend := alpnBackend(r); backend != "" {
+		return backend
+	}
+	if backend := langBackend(r); backend != "" {
+		return backend
+	}
+	domain := configuredDomain(r.Host)
+	if backend := canaryBackend(domain); backend != "" {
+		return backend
+	}
+	if pool, found := domain_pool[domain]; found {
+		return pool.pick()
+	}
+	if srv, found := domain_srv[domain]; found {
+		if target := srv.pick(); target != "" {
+			return "http://" + target
+		}
+		return ""
+	}
+	return domain_backend[domain]
+}
+
 // the proxy handler
 func handler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.Host = strings.SplitN(r.Host, ":", 2)[0]
-		if _, found := domain_backend[r.Host]; !found {
+		if acmeALPN(r) {
+			http.Error(w, "tls-alpn-01 challenge connection", http.StatusMisdirectedRequest)
+			return
+		}
+		if !supportedProto(r) {
+			http.Error(w, r.Proto+": unsupported protocol version", http.StatusBadRequest)
+			return
+		}
+		// net/http already turns down the requests with several Host headers
+		r.Host = hostOf(r.Host)
+		if !validHostname(r.Host) {
+			http.Error(w, "invalid Host header", http.StatusBadRequest)
+			return
+		}
+		if target, found := domain_redirect[r.Host]; found {
+			// the redirect must carry hsts as well, otherwise the domain isn't preload eligible
+			if *hsts != "" {
+				w.Header().Set("Strict-Transport-Security", *hsts)
+			}
+			http.Redirect(w, r, "https://"+target+r.URL.RequestURI(), http.StatusMovedPermanently)
+			return
+		}
+		if _, found := domain_backend[r.Host]; !found && baseDomainOf(r.Host) == "" {
 			http.Error(w, r.Host+": not found", http.StatusNotImplemented)
 			return
 		}
-		r.Header["X-Forwarded-Proto"] = []string{"https"}
-		r.Header["X-Forwarded-For"] = append(r.Header["X-Forwarded-For"], strings.SplitN(r.RemoteAddr, ":", 2)[0])
-		u, _ := url.Parse(domain_backend[r.Host] + "/" + strings.TrimLeft(r.URL.RequestURI(), "/"))
+		if !overrideMethod(r) {
+			http.Error(w, "method override not allowed", http.StatusBadRequest)
+			return
+		}
+		if domain_close_connection[r.Host] && r.ProtoMajor == 1 && r.Header.Get("Upgrade") == "" {
+			w.Header().Set("Connection", "close")
+		}
+		if uaBlocked(r) {
+			http.Error(w, *uaBlockBody, *uaBlockStatus)
+			return
+		}
+		if geoBlocked(r) {
+			http.Error(w, http.StatusText(*geoBlockStatus), *geoBlockStatus)
+			return
+		}
+		if !rateLimit(w, r) {
+			return
+		}
+		release, admitted := admitQoS(r)
+		if !admitted {
+			http.Error(w, "overloaded, try again later", http.StatusServiceUnavailable)
+			return
+		}
+		defer release()
+		if !checkRequiredHeaders(w, r) {
+			return
+		}
+		if upgrade := r.Header.Get("Upgrade"); upgrade != "" && !upgradeAllowed(r.Host, upgrade) {
+			http.Error(w, upgrade+": upgrade not allowed", http.StatusBadRequest)
+			return
+		}
+		if _, found := domain_nel[r.Host]; found && *nelReportPath != "" && r.URL.Path == *nelReportPath {
+			nelReportHandler(w, r)
+			return
+		}
+		if client := forwardedClient(r); client != nil && client["host"] != "" {
+			r.Header.Set("X-Forwarded-Host", client["host"])
+		}
+		r.Header["X-Forwarded-Proto"] = []string{forwardedProto(r)}
+		forwardTo(r)
+		if *tlsFingerprintHdr {
+			r.Header.Del("X-Tls-Fingerprint")
+			if fingerprint := tlsFingerprint(r); fingerprint != "" {
+				r.Header.Set("X-Tls-Fingerprint", fingerprint)
+			}
+		}
+		r.Header["X-Forwarded-For"] = append(r.Header["X-Forwarded-For"], peerIP(r))
+		base := backendOf(r)
+		if base == "" {
+			http.Error(w, r.Host+": no backend available", http.StatusServiceUnavailable)
+			return
+		}
+		u, _ := url.Parse(base + "/" + strings.TrimLeft(r.URL.RequestURI(), "/"))
 		if strings.ToLower(r.Header.Get("Upgrade")) == "websocket" {
 			NewWebsocketReverseProxy(u).ServeHTTP(w, r)
 			return
 		} else {
-			proxy := httputil.NewSingleHostReverseProxy(u)
-			defaultDirector := proxy.Director
-			proxy.Director = func(req *http.Request) {
-				defaultDirector(req)
-				req.Host = r.Host
-				req.URL = u
+			if err := rewriteRequestJSON(r); err != nil {
+				http.Error(w, "can't read the request body", http.StatusBadRequest)
+				return
+			}
+			claim, served := claimIdempotencyKey(w, r)
+			if served {
+				return
+			}
+			if claim != nil {
+				iw := &idempotencyWriter{ResponseWriter: w}
+				w = iw
+				defer claim.finish(iw)
+			}
+			if timeout := timeoutOf(r.Host, r.URL.Path); timeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), timeout)
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			if limiter := limiterOf(u.Host); limiter != nil {
+				if err := limiter.acquire(r.Context(), r.Host); err != nil {
+					if errors.Is(r.Context().Err(), context.Canceled) {
+						clientCancelled.Add(1)
+						return
+					}
+					http.Error(w, r.Host+": backend is busy", http.StatusServiceUnavailable)
+					return
+				}
+				defer limiter.release()
 			}
-			proxy.ServeHTTP(w, r)
+			if coalescable(r) {
+				serveCoalesced(w, r, u)
+				return
+			}
+			serveProxy(w, r, u, map[string]bool{u.Host: true})
 			return
 		}
 	})
 }
 
+// proxy the request to the specified backend url
+func serveProxy(w http.ResponseWriter, r *http.Request, u *url.URL, tried map[string]bool) {
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	proxy.Transport = transportOf(r.Host)
+	if cases, found := domain_header_case[r.Host]; found {
+		proxy.Transport = headerCaseTransport{transportOf(r.Host), cases}
+	}
+	defaultDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		defaultDirector(req)
+		req.Host = r.Host
+		req.URL = u
+		if headAsGet(r) {
+			req.Method = http.MethodGet
+		}
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		recordCanary(configuredDomain(r.Host), u.Host, res.StatusCode)
+		setDefaultCharset(r.Host, res.Header)
+		switch {
+		case replaceWithStale(r, res):
+			setCacheStatus(r, res.Header, "STALE")
+		case storeStale(r, res) || coalescable(r):
+			setCacheStatus(r, res.Header, "MISS")
+		default:
+			setCacheStatus(r, res.Header, "BYPASS")
+		}
+		if *hsts != "" && res.Header.Get("Strict-Transport-Security") == "" {
+			res.Header.Set("Strict-Transport-Security", *hsts)
+		}
+		setNelHeaders(r.Host, res.Header)
+		if headAsGet(r) {
+			discardBody(res)
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
+		proxyError(w, r, u, tried, err)
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// the proxy error handler
+// a backend that accepts the request then closes the connection
+// without writing any response is reported separately, so it can be
+// told apart from refused connections and timeouts .
+func proxyError(w http.ResponseWriter, r *http.Request, u *url.URL, tried map[string]bool, err error) {
+	// the client went away, the transport already gave up on the backend request
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		clientCancelled.Add(1)
+		return
+	}
+	recordCanary(configuredDomain(r.Host), u.Host, http.StatusBadGateway)
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		backendConnectErrors.Add(1)
+		log.Printf("%s: can't connect to backend %s: %v", r.Host, u.Host, err)
+		if next := failover(r, tried); next != nil {
+			tried[next.Host] = true
+			if r.GetBody != nil {
+				r.Body, _ = r.GetBody()
+			}
+			serveProxy(w, r, next, tried)
+			return
+		}
+		if !serveStale(w, r) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		return
+	}
+	if serveStale(w, r) {
+		log.Printf("%s: backend %s: %v, served a stale response", r.Host, u.Host, err)
+		return
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		backendEmptyResponses.Add(1)
+		log.Printf("%s: backend %s closed the connection without a response", r.Host, u.Host)
+		http.Error(w, "backend closed the connection without a response", http.StatusBadGateway)
+		return
+	}
+	var timeout interface{ Timeout() bool }
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &timeout) && timeout.Timeout()) {
+		backendTimeouts.Add(1)
+		log.Printf("%s: backend %s didn't respond in time: %v", r.Host, u.Host, err)
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	backendErrors.Add(1)
+	log.Printf("%s: backend %s: %v", r.Host, u.Host, err)
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+// the next backend to fail over to after a connect failure, nil when there is none .
+// only the bodyless requests and the ones whose body can be read again fail over,
+// since the body of the others has been consumed .
+func failover(r *http.Request, tried map[string]bool) *url.URL {
+	pool, found := domain_pool[configuredDomain(r.Host)]
+	if !found || (r.Body != http.NoBody && r.GetBody == nil) {
+		return nil
+	}
+	for _, upstream := range pool.upstreams {
+		u, err := url.Parse(upstream.url + "/" + strings.TrimLeft(r.URL.RequestURI(), "/"))
+		if err == nil && !tried[u.Host] && !upstream.down.Load() {
+			return u
+		}
+	}
+	return nil
+}
+
+// dial the websocket backend, retrying -ws-dial-retries times with a doubling -ws-dial-retry-interval,
+// a pooled domain retries on its other backends first, it all happens before the client connection is hijacked .
+func dialWebsocketBackend(r *http.Request, u *url.URL) (net.Conn, error) {
+	tried := map[string]bool{u.Host: true}
+	interval := *wsRetryInterval
+	for attempt := 0; ; attempt++ {
+		conn, err := transportOf(r.Host).DialContext(r.Context(), "tcp", u.Host)
+		if err == nil || attempt >= *wsDialRetries || r.Context().Err() != nil {
+			return conn, err
+		}
+		log.Printf("%s: can't connect to websocket backend %s: %v, retrying", r.Host, u.Host, err)
+		if next := failover(r, tried); next != nil {
+			tried[next.Host] = true
+			u = next
+			continue
+		}
+		// every backend has been tried, start over after a pause
+		tried = map[string]bool{u.Host: true}
+		select {
+		case <-time.After(interval):
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+		interval *= 2
+	}
+}
+
 // the websocket proxy handler
 func NewWebsocketReverseProxy(u *url.URL) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		backConn, err := net.Dial("tcp", u.Host)
+		ip := clientIP(r)
+		if !wsConns.acquire(ip, *wsMaxPerIP) {
+			http.Error(w, "too many websocket connections", http.StatusTooManyRequests)
+			return
+		}
+		defer wsConns.release(ip)
+		backConn, err := dialWebsocketBackend(r, u)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -153,7 +811,9 @@ func NewWebsocketReverseProxy(u *url.URL) http.Handler {
 			return
 		}
 		defer clientConn.Close()
-		message := r.Method + " " + r.URL.RequestURI() + " " + r.Proto + "\n"
+		respellHeader(r.Header, domain_header_case[r.Host])
+		// the handshake is an HTTP/1.1 one whatever the client spelled
+		message := r.Method + " " + r.URL.RequestURI() + " HTTP/1.1\n"
 		message += "Host: " + r.Host + "\n"
 		for k, vals := range r.Header {
 			for _, v := range vals {
@@ -161,7 +821,6 @@ func NewWebsocketReverseProxy(u *url.URL) http.Handler {
 			}
 		}
 		message += "\n"
-		go io.Copy(backConn, io.MultiReader(strings.NewReader(message), r.Body, clientConn))
-		io.Copy(clientConn, backConn)
+		pipeWebsocket(r.Host, clientConn, backConn, io.MultiReader(strings.NewReader(message), r.Body, clientConn))
 	})
 }
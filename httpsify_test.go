@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send the raw request to a server running the proxy handler and return the response
+func rawRequest(t *testing.T, h http.Handler, request string) *http.Response {
+	t.Helper()
+	server := httptest.NewServer(h)
+	defer server.Close()
+	c, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+func TestHostHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		request string
+	}{
+		{"duplicate Host", "GET / HTTP/1.1\r\nHost: a.test\r\nHost: b.test\r\n\r\n"},
+		{"duplicate identical Host", "GET / HTTP/1.1\r\nHost: a.test\r\nHost: a.test\r\n\r\n"},
+		{"missing Host", "GET / HTTP/1.1\r\n\r\n"},
+		{"underscore", "GET / HTTP/1.1\r\nHost: a_b.test\r\n\r\n"},
+		{"leading hyphen", "GET / HTTP/1.1\r\nHost: -a.test\r\n\r\n"},
+		{"empty label", "GET / HTTP/1.1\r\nHost: a..test\r\n\r\n"},
+		{"space", "GET / HTTP/1.1\r\nHost: a test\r\n\r\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := rawRequest(t, handler(), tt.request); res.StatusCode != http.StatusBadRequest {
+				t.Fatalf("got %s, want 400", res.Status)
+			}
+		})
+	}
+}
+
+func TestValidHostname(t *testing.T) {
+	for host, valid := range map[string]bool{
+		"a.test":                        true,
+		"a.test.":                       true,
+		"a.test:443":                    true,
+		"A.Test:443":                    true,
+		"a-b.test:8443":                 true,
+		"127.0.0.1":                     true,
+		"127.0.0.1:443":                 true,
+		"[::1]":                         true,
+		"[::1]:443":                     true,
+		"[2001:db8::1]:8443":            true,
+		"":                              false,
+		":443":                          false,
+		"a_b.test":                      false,
+		"-a.test":                       false,
+		"a-.test":                       false,
+		"a..test":                       false,
+		"[not-ip]:443":                  false,
+		strings.Repeat("a", 64):         false,
+		strings.Repeat("a.", 126) + "a": true,
+		strings.Repeat("ab.", 100):      false,
+	} {
+		if validHostname(hostOf(host)) != valid {
+			t.Errorf("validHostname(hostOf(%q)) = %v, want %v", host, !valid, valid)
+		}
+	}
+}
+
+func TestRedirectCarriesHSTS(t *testing.T) {
+	defer func(saved map[string]string, value string) { domain_redirect, *hsts = saved, value }(domain_redirect, *hsts)
+	domain_redirect = map[string]string{"www.a.test": "a.test"}
+	*hsts = "max-age=63072000; includeSubDomains; preload"
+	rec := httptest.NewRecorder()
+	handler().ServeHTTP(rec, httptest.NewRequest("GET", "https://www.a.test/page?q=1", nil))
+	if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != "https://a.test/page?q=1" {
+		t.Fatalf("got %d to %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if got := rec.Header().Get("Strict-Transport-Security"); got != *hsts {
+		t.Fatalf("the redirect carries Strict-Transport-Security %q, want %q", got, *hsts)
+	}
+}
+
+func TestClientDisconnectCancelsBackendRequest(t *testing.T) {
+	arrived, cancelled := make(chan struct{}), make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(arrived)
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	proxied := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(proxied)
+		serveProxy(w, r, u, map[string]bool{u.Host: true})
+	}))
+	defer server.Close()
+
+	before := clientCancelled.Value()
+	ctx, disconnect := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	go http.DefaultClient.Do(req)
+	<-arrived
+	disconnect()
+	for done, failure := range map[chan struct{}]string{cancelled: "the backend request wasn't cancelled", proxied: "the proxy didn't return"} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal(failure)
+		}
+	}
+	if got := clientCancelled.Value() - before; got != 1 {
+		t.Fatalf("client_cancelled_requests grew by %d, want 1", got)
+	}
+}
+
+func TestProtocolLines(t *testing.T) {
+	for line, status := range map[string]int{
+		// turned down by net/http before the handler runs
+		"GET / HTTP/0.9":  http.StatusHTTPVersionNotSupported,
+		"GET / HTTP/2.0":  http.StatusHTTPVersionNotSupported,
+		"GET / HTTP/3.0":  http.StatusHTTPVersionNotSupported,
+		"GET /":           http.StatusBadRequest,
+		"GET / HTTP/1.01": http.StatusBadRequest,
+		"GET / HTTP/1.10": http.StatusBadRequest,
+		"GET / HTTP/x":    http.StatusBadRequest,
+		"GET / http/1.1":  http.StatusBadRequest,
+		// turned down by the handler
+		"GET / HTTP/1.2": http.StatusBadRequest,
+		"GET / HTTP/1.9": http.StatusBadRequest,
+		// proxied, to an unknown domain here
+		"GET / HTTP/1.0": http.StatusNotImplemented,
+		"GET / HTTP/1.1": http.StatusNotImplemented,
+	} {
+		if res := rawRequest(t, handler(), line+"\r\nHost: unknown.test\r\n\r\n"); res.StatusCode != status {
+			t.Errorf("%q: got %s, want %d", line, res.Status, status)
+		}
+	}
+}
+
+func TestCloseConnectionOnlyOnHTTP1(t *testing.T) {
+	defer func(saved map[string]bool, backends map[string]string) {
+		domain_close_connection, domain_backend = saved, backends
+	}(domain_close_connection, domain_backend)
+	domain_close_connection = map[string]bool{"a.test": true}
+	domain_backend = map[string]string{"a.test": "http://127.0.0.1:1"}
+	for major, want := range map[int]string{1: "close", 2: ""} {
+		r := httptest.NewRequest("GET", "https://a.test/", nil)
+		r.ProtoMajor = major
+		rec := httptest.NewRecorder()
+		handler().ServeHTTP(rec, r)
+		if got := rec.Header().Get("Connection"); got != want {
+			t.Errorf("HTTP/%d: Connection %q, want %q", major, got, want)
+		}
+	}
+}
+
+// send a request expecting 100 Continue through the proxy handler to a backend, which route makes
+// the backend of a.test, returning the number of 100 responses before the final response,
+// and the headers and body the backend got .
+func expectContinueRequest(t *testing.T, route func(backend string), target, body string, header http.Header) (int, *http.Response, http.Header, string) {
+	t.Helper()
+	var got struct {
+		header http.Header
+		body   string
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		got.header, got.body = r.Header.Clone(), string(b)
+	}))
+	defer backend.Close()
+	route(backend.URL)
+	server := httptest.NewServer(handler())
+	defer server.Close()
+	c, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	request := "POST " + target + " HTTP/1.1\r\nHost: a.test\r\nExpect: 100-continue\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n"
+	for k, vals := range header {
+		for _, v := range vals {
+			request += k + ": " + v + "\r\n"
+		}
+	}
+	if _, err := io.WriteString(c, request+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	continues := 0
+	for {
+		res, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusContinue {
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+			return continues, res, got.header, got.body
+		}
+		if continues++; continues == 1 {
+			io.WriteString(c, body)
+		}
+	}
+}
+
+func TestExpectContinueWithBufferedBodies(t *testing.T) {
+	defer func(backends map[string]string, pools map[string]*backendPool, rewrites map[string][]jsonRewrite, scopes map[string][]idempotencyScope, store *lru) {
+		domain_backend, domain_pool, domain_json_request_rewrites, domain_idempotency, idempotencyStore = backends, pools, rewrites, scopes, store
+	}(domain_backend, domain_pool, domain_json_request_rewrites, domain_idempotency, idempotencyStore)
+	domain_json_request_rewrites, domain_idempotency = map[string][]jsonRewrite{}, map[string][]idempotencyScope{}
+	parseJSONRequestRewrites("a.test/json->name=title")
+	parseIdempotency("a.test/orders")
+	backend := func(url string) {
+		domain_backend, domain_pool = map[string]string{"a.test": url}, map[string]*backendPool{}
+	}
+	// the first pick of the pool is the unreachable backend
+	pool := func(url string) {
+		spec := "http://127.0.0.1:1|" + url
+		domain_backend = map[string]string{"a.test": spec}
+		domain_pool = map[string]*backendPool{"a.test": parsePool(spec)}
+		domain_pool["a.test"].next = 1
+	}
+	json := http.Header{"Content-Type": {"application/json"}}
+
+	for _, tt := range []struct {
+		name          string
+		route         func(string)
+		target, body  string
+		header        http.Header
+		want          string
+		connectErrors int64
+	}{
+		{"json request rewrite", backend, "/json", `{"name":"one"}`, json, `{"title":"one"}`, 0},
+		{"idempotency", backend, "/orders", "order one", http.Header{"Idempotency-Key": {"continue-1"}}, "order one", 0},
+		{"json request rewrite failover", pool, "/json", `{"name":"two"}`, json, `{"title":"two"}`, 1},
+		{"idempotency failover", pool, "/orders", "order two", http.Header{"Idempotency-Key": {"continue-2"}}, "order two", 1},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			before := backendConnectErrors.Value()
+			continues, res, header, body := expectContinueRequest(t, tt.route, tt.target, tt.body, tt.header)
+			if continues != 1 {
+				t.Fatalf("the client got %d 100 Continue, want 1", continues)
+			}
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("got %s", res.Status)
+			}
+			if got := backendConnectErrors.Value() - before; got != tt.connectErrors {
+				t.Fatalf("%d backends couldn't be reached, want %d", got, tt.connectErrors)
+			}
+			if header == nil || header.Get("Expect") != "" {
+				t.Fatalf("the backend got the headers %v", header)
+			}
+			if body != tt.want {
+				t.Fatalf("the backend got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
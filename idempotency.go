@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the methods whose Idempotency-Key is honored under a path prefix of a domain
+type idempotencyScope struct {
+	prefix  string
+	methods map[string]bool
+}
+
+// the idempotency scopes of each domain, the longest prefix first
+var domain_idempotency = map[string][]idempotencyScope{}
+
+// the response to an idempotency key, res is set before done is closed
+// and stays nil when the response isn't worth replaying .
+// body is the hash of the request body the key was first used with, key its store key .
+type idempotentResponse struct {
+	done chan struct{}
+	res  *cachedResponse
+	body [sha256.Size]byte
+	key  string
+}
+
+var (
+	// the replayable responses of the idempotency keys, nil when -idempotency isn't set
+	idempotencyStore *lru
+	// the claims of the keys whose first request is in flight, kept out of the store
+	// so they can't be evicted from under it, they move there once answered .
+	idempotencyInFlight = map[string]*idempotentResponse{}
+	// serializes the claims of the idempotency keys
+	idempotencyMu sync.Mutex
+)
+
+// parse the -idempotency flag of domain[/path-prefix]->METHOD|METHOD, POST when no method is given
+func parseIdempotency(s string) {
+	for zone, value := range parseZones(s) {
+		domain, prefix := zone, "/"
+		if i := strings.Index(zone, "/"); i >= 0 {
+			domain, prefix = zone[:i], zone[i:]
+		}
+		scope := idempotencyScope{prefix, map[string]bool{}}
+		for _, method := range strings.Split(value, "|") {
+			if method = strings.TrimSpace(method); method != "" {
+				scope.methods[strings.ToUpper(method)] = true
+			}
+		}
+		if len(scope.methods) == 0 {
+			scope.methods[http.MethodPost] = true
+		}
+		scopes := append(domain_idempotency[domain], scope)
+		for i := len(scopes) - 1; i > 0 && len(scopes[i].prefix) > len(scopes[i-1].prefix); i-- {
+			scopes[i], scopes[i-1] = scopes[i-1], scopes[i]
+		}
+		domain_idempotency[domain] = scopes
+	}
+	if len(domain_idempotency) > 0 {
+		if *idempotencySize <= 0 {
+			log.Fatal("-idempotency requires a positive -idempotency-size")
+		}
+		idempotencyStore = newLRU(*idempotencySize, *idempotencyBytes)
+	}
+}
+
+// the store key of the Idempotency-Key of the specified request, empty when it isn't honored .
+// the key is scoped to the client, that is its Authorization or else its ip address,
+// so a client reusing or guessing the key of another one doesn't get its response .
+func idempotencyKeyOf(r *http.Request) string {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		return ""
+	}
+	for _, scope := range domain_idempotency[r.Host] {
+		if strings.HasPrefix(r.URL.Path, scope.prefix) {
+			if !scope.methods[r.Method] {
+				return ""
+			}
+			client := r.Header.Get("Authorization")
+			if client == "" {
+				client = clientIP(r)
+			}
+			identity := sha256.Sum256([]byte(client))
+			return r.Host + "\x00" + r.Method + "\x00" + r.URL.Path + "\x00" + string(identity[:]) + "\x00" + key
+		}
+	}
+	return ""
+}
+
+// whether the key may be claimed again, that is its first request is over without a replayable response
+func (e *idempotentResponse) settled() bool {
+	select {
+	case <-e.done:
+		return e.res == nil || time.Now().After(e.res.expires)
+	default:
+		return false
+	}
+}
+
+// claim the Idempotency-Key of the request, the returned response must be finished once proxied .
+// a duplicate of an answered request gets the recorded response and served is true,
+// a duplicate of an in flight request waits for its response first,
+// and the key coming back with another body is turned down with a 422 .
+func claimIdempotencyKey(w http.ResponseWriter, r *http.Request) (claim *idempotentResponse, served bool) {
+	key := ""
+	if idempotencyStore != nil {
+		key = idempotencyKeyOf(r)
+	}
+	if key == "" {
+		return nil, false
+	}
+	body, ok, err := hashRequestBody(r)
+	if err != nil {
+		http.Error(w, "can't read the request body", http.StatusBadRequest)
+		return nil, true
+	}
+	if !ok {
+		return nil, false
+	}
+	for {
+		idempotencyMu.Lock()
+		e, found := idempotencyInFlight[key]
+		if !found {
+			if v, stored := idempotencyStore.get(key); stored && !v.(*idempotentResponse).settled() {
+				e, found = v.(*idempotentResponse), true
+			}
+		}
+		if !found {
+			claim = &idempotentResponse{done: make(chan struct{}), body: body, key: key}
+			idempotencyInFlight[key] = claim
+			idempotencyMu.Unlock()
+			return claim, false
+		}
+		idempotencyMu.Unlock()
+		if e.body != body {
+			http.Error(w, "Idempotency-Key reused with another request body", http.StatusUnprocessableEntity)
+			return nil, true
+		}
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return nil, true
+		}
+		if res := e.res; res != nil && time.Now().Before(res.expires) {
+			for k, vals := range res.header.Clone() {
+				w.Header()[k] = vals
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(res.code)
+			w.Write(res.body)
+			return nil, true
+		}
+	}
+}
+
+// hash the request body, which is read whole so it can still be proxied and read again by a failover,
+// ok is false when it outgrows -max-transform-size, its key isn't honored then .
+func hashRequestBody(r *http.Request) (sum [sha256.Size]byte, ok bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return sha256.Sum256(nil), true, nil
+	}
+	if r.GetBody != nil {
+		body, err := r.GetBody()
+		if err != nil {
+			return sum, false, err
+		}
+		defer body.Close()
+		h := sha256.New()
+		if _, err := io.Copy(h, body); err != nil {
+			return sum, false, err
+		}
+		copy(sum[:], h.Sum(nil))
+		return sum, true, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(*maxTransformSize)+1))
+	if err != nil {
+		return sum, false, err
+	}
+	if len(body) > *maxTransformSize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return sum, false, nil
+	}
+	r.Body.Close()
+	r.Header.Del("Expect")
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return sha256.Sum256(body), true, nil
+}
+
+// record the response written through the specified writer for the duplicates of the request,
+// moving the claim from the in flight ones to the store where it counts towards -idempotency-bytes .
+// the failed and oversized responses aren't, so a retry reaches the backend again .
+func (e *idempotentResponse) finish(iw *idempotencyWriter) {
+	p := recover()
+	idempotencyMu.Lock()
+	delete(idempotencyInFlight, e.key)
+	if p == nil && iw.code != 0 && iw.code < 500 && !iw.overflow {
+		e.res = &cachedResponse{iw.code, iw.Header().Clone(), iw.buf.Bytes(), time.Now().Add(*idempotencyTTL)}
+		idempotencyStore.add(e.key, e, int64(iw.buf.Len()))
+	}
+	idempotencyMu.Unlock()
+	close(e.done)
+	if p != nil {
+		panic(p)
+	}
+}
+
+// a response writer keeping a copy of a response up to -max-transform-size
+type idempotencyWriter struct {
+	http.ResponseWriter
+	code     int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (iw *idempotencyWriter) WriteHeader(code int) {
+	if iw.code == 0 {
+		iw.code = code
+	}
+	iw.ResponseWriter.WriteHeader(code)
+}
+
+func (iw *idempotencyWriter) Write(b []byte) (int, error) {
+	if iw.code == 0 {
+		iw.code = http.StatusOK
+	}
+	if !iw.overflow {
+		if iw.buf.Len()+len(b) > *maxTransformSize {
+			iw.overflow = true
+			iw.buf.Reset()
+		} else {
+			iw.buf.Write(b)
+		}
+	}
+	return iw.ResponseWriter.Write(b)
+}
+
+func (iw *idempotencyWriter) Flush() {
+	if f, ok := iw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
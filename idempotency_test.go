@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// send the request through the idempotency claim, the backend answering it with its body
+func idempotentRequest(t *testing.T, remoteAddr, authorization, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "https://a.test/orders", strings.NewReader(body))
+	r.Host = "a.test"
+	r.RemoteAddr = remoteAddr
+	r.Header.Set("Idempotency-Key", "order-1")
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	rec := httptest.NewRecorder()
+	claim, served := claimIdempotencyKey(rec, r)
+	if served {
+		return rec
+	}
+	if claim == nil {
+		t.Fatal("the Idempotency-Key wasn't claimed")
+	}
+	iw := &idempotencyWriter{ResponseWriter: rec}
+	sent, _ := io.ReadAll(r.Body)
+	iw.WriteHeader(http.StatusCreated)
+	iw.Write(sent)
+	claim.finish(iw)
+	return rec
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	defer func(saved map[string][]idempotencyScope, store *lru) {
+		domain_idempotency, idempotencyStore = saved, store
+	}(domain_idempotency, idempotencyStore)
+	domain_idempotency = map[string][]idempotencyScope{}
+	parseIdempotency("a.test")
+
+	first := idempotentRequest(t, "192.0.2.1:1000", "", "one")
+	if first.Code != http.StatusCreated || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("the first request got %d %v", first.Code, first.Header())
+	}
+	replay := idempotentRequest(t, "192.0.2.1:2000", "", "one")
+	if replay.Code != http.StatusCreated || replay.Header().Get("Idempotent-Replayed") != "true" || replay.Body.String() != "one" {
+		t.Fatalf("the duplicate got %d %q %v", replay.Code, replay.Body.String(), replay.Header())
+	}
+	if res := idempotentRequest(t, "192.0.2.1:3000", "", "two"); res.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("the key reused with another body got %d, want 422", res.Code)
+	}
+	if res := idempotentRequest(t, "192.0.2.2:1000", "", "one"); res.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("another client got the response of the key")
+	}
+	if res := idempotentRequest(t, "192.0.2.1:4000", "Bearer other", "one"); res.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatal("another authorization got the response of the key")
+	}
+}
+
+func TestIdempotencyClaimOutlivesEviction(t *testing.T) {
+	defer func(saved map[string][]idempotencyScope, store *lru, size int) {
+		domain_idempotency, idempotencyStore, *idempotencySize = saved, store, size
+	}(domain_idempotency, idempotencyStore, *idempotencySize)
+	domain_idempotency = map[string][]idempotencyScope{}
+	*idempotencySize = 1
+	parseIdempotency("a.test")
+
+	request := func(key string) *http.Request {
+		r := httptest.NewRequest("POST", "https://a.test/orders", strings.NewReader("one"))
+		r.Host = "a.test"
+		r.Header.Set("Idempotency-Key", key)
+		return r
+	}
+	claim, _ := claimIdempotencyKey(httptest.NewRecorder(), request("in-flight"))
+	if claim == nil {
+		t.Fatal("the Idempotency-Key wasn't claimed")
+	}
+	// the store is filled with another key's response while the first request runs
+	idempotentRequest(t, "192.0.2.1:1000", "", "other")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	duplicate := request("in-flight").WithContext(ctx)
+	waited := make(chan *idempotentResponse)
+	go func() {
+		claim, _ := claimIdempotencyKey(httptest.NewRecorder(), duplicate)
+		waited <- claim
+	}()
+	select {
+	case again := <-waited:
+		t.Fatalf("the retry of the in flight request claimed its key again: %v", again != nil)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	<-waited
+	claim.finish(&idempotencyWriter{ResponseWriter: httptest.NewRecorder()})
+	if len(idempotencyInFlight) != 0 {
+		t.Fatal("the finished claim is still in flight")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the field rewrites applied to the json responses under a path prefix of a domain
+type jsonRewrite struct {
+	prefix string
+	rename map[string]string
+	remove []string
+	add    map[string]json.RawMessage
+}
+
+// the json response rewrites of each domain, the longest prefix first
+var domain_json_rewrites = map[string][]jsonRewrite{}
+
+// the json request body rewrites of each domain, the longest prefix first
+var domain_json_request_rewrites = map[string][]jsonRewrite{}
+
+// parse the -json-rewrite flag and register the json transformer
+func parseJSONRewrites(s string) {
+	parseJSONRules("json-rewrite", s, domain_json_rewrites)
+	if len(domain_json_rewrites) > 0 {
+		transformers = append(transformers, jsonTransformer)
+	}
+}
+
+// parse the -json-request-rewrite flag
+func parseJSONRequestRewrites(s string) {
+	parseJSONRules("json-request-rewrite", s, domain_json_request_rewrites)
+}
+
+// parse a flag of domain[/path-prefix]->old=new|-removed|+added=value into the specified map,
+// added values that aren't valid json are added as strings .
+func parseJSONRules(name, s string, into map[string][]jsonRewrite) {
+	for zone, value := range parseZones(s) {
+		domain, prefix := zone, "/"
+		if i := strings.Index(zone, "/"); i >= 0 {
+			domain, prefix = zone[:i], zone[i:]
+		}
+		rw := jsonRewrite{prefix: prefix, rename: map[string]string{}, add: map[string]json.RawMessage{}}
+		for _, rule := range strings.Split(value, "|") {
+			rule = strings.TrimSpace(rule)
+			if rule == "" {
+				continue
+			}
+			field, arg, _ := strings.Cut(rule[1:], "=")
+			switch {
+			case rule[0] == '-':
+				rw.remove = append(rw.remove, field)
+			case rule[0] == '+':
+				if !json.Valid([]byte(arg)) {
+					quoted, _ := json.Marshal(arg)
+					arg = string(quoted)
+				}
+				rw.add[field] = json.RawMessage(arg)
+			default:
+				old, renamed, found := strings.Cut(rule, "=")
+				if !found || old == "" || renamed == "" {
+					log.Fatalf("-%s: %s: invalid rule %q", name, zone, rule)
+				}
+				rw.rename[old] = renamed
+			}
+		}
+		rewrites := append(into[domain], rw)
+		for i := len(rewrites) - 1; i > 0 && len(rewrites[i].prefix) > len(rewrites[i-1].prefix); i-- {
+			rewrites[i], rewrites[i-1] = rewrites[i-1], rewrites[i]
+		}
+		into[domain] = rewrites
+	}
+}
+
+// the rewrite of the path of the request, nil when there is none
+func jsonRewriteOf(rewrites map[string][]jsonRewrite, r *http.Request) *jsonRewrite {
+	for i, rw := range rewrites[r.Host] {
+		if strings.HasPrefix(r.URL.Path, rw.prefix) {
+			return &rewrites[r.Host][i]
+		}
+	}
+	return nil
+}
+
+// rewrite the fields of the top level object, or of each object of a top level array, of json responses,
+// bodies that don't parse are left alone .
+func jsonTransformer(r *http.Request, h http.Header) func([]byte) []byte {
+	if mediaTypeOf(h) != "application/json" {
+		return nil
+	}
+	if rw := jsonRewriteOf(domain_json_rewrites, r); rw != nil {
+		return rw.apply
+	}
+	return nil
+}
+
+// rewrite the json request body before it is proxied, the body is read whole, which sends
+// the client its 100 Continue, so Expect isn't forwarded, and it can be read again by a failover .
+// a body outgrowing -max-transform-size or that doesn't parse is forwarded as is .
+func rewriteRequestJSON(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || mediaTypeOf(r.Header) != "application/json" {
+		return nil
+	}
+	rw := jsonRewriteOf(domain_json_request_rewrites, r)
+	if rw == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(*maxTransformSize)+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > *maxTransformSize {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil
+	}
+	r.Body.Close()
+	body = rw.apply(body)
+	r.Header.Del("Expect")
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return nil
+}
+
+func (rw jsonRewrite) apply(body []byte) []byte {
+	var object map[string]json.RawMessage
+	if json.Unmarshal(body, &object) == nil {
+		rw.rewrite(object)
+		if rewritten, err := json.Marshal(object); err == nil {
+			return rewritten
+		}
+		return body
+	}
+	var array []json.RawMessage
+	if json.Unmarshal(body, &array) != nil {
+		return body
+	}
+	for i, element := range array {
+		if json.Unmarshal(element, &object) != nil {
+			continue
+		}
+		rw.rewrite(object)
+		if rewritten, err := json.Marshal(object); err == nil {
+			array[i] = rewritten
+		}
+		object = nil
+	}
+	if rewritten, err := json.Marshal(array); err == nil {
+		return rewritten
+	}
+	return body
+}
+
+func (rw jsonRewrite) rewrite(object map[string]json.RawMessage) {
+	for old, renamed := range rw.rename {
+		if value, found := object[old]; found {
+			delete(object, old)
+			object[renamed] = value
+		}
+	}
+	for _, field := range rw.remove {
+		delete(object, field)
+	}
+	for field, value := range rw.add {
+		object[field] = value
+	}
+}
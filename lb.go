@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// a backend of a load balanced domain, it is left out of the rotation while down
+type upstream struct {
+	url    string
+	weight int
+	down   atomic.Bool
+}
+
+// the backends of a load balanced domain
+type backendPool struct {
+	upstreams []*upstream
+	next      uint64
+}
+
+// the pool of each load balanced domain
+var domain_pool = map[string]*backendPool{}
+
+// parse a pool of [ip]:port[@weight]|[ip]:port[@weight] backends
+func parsePool(spec string) *backendPool {
+	pool := &backendPool{}
+	for _, item := range strings.Split(spec, "|") {
+		backend, weight := splitWeight(item)
+		pool.upstreams = append(pool.upstreams, &upstream{url: fixUrl(backend), weight: weight})
+	}
+	return pool
+}
+
+// split the backend of a [ip]:port[@weight] item from its weight, 1 when it has none,
+// what follows the last @ is the host of the backend's userinfo when it has a port or a path .
+func splitWeight(item string) (string, int) {
+	item = strings.TrimSpace(item)
+	i := strings.LastIndex(item, "@")
+	if i < 0 || strings.ContainsAny(item[i+1:], ":/") {
+		return item, 1
+	}
+	weight, err := strconv.Atoi(item[i+1:])
+	if err != nil || weight < 0 {
+		log.Fatalf("%s: invalid backend weight", item)
+	}
+	return item[:i], weight
+}
+
+// pick a backend using -lb-strategy
+func (p *backendPool) pick() string {
+	if *lbStrategy == "weighted-random" {
+		return p.pickWeightedRandom()
+	}
+	next := atomic.AddUint64(&p.next, 1)
+	for i := range p.upstreams {
+		if u := p.upstreams[(next+uint64(i))%uint64(len(p.upstreams))]; !u.down.Load() {
+			return u.url
+		}
+	}
+	return ""
+}
+
+// pick a backend at random, each backend is picked proportionally to its weight
+func (p *backendPool) pickWeightedRandom() string {
+	up := []*upstream{}
+	total := 0
+	for _, u := range p.upstreams {
+		if !u.down.Load() {
+			up = append(up, u)
+			total += u.weight
+		}
+	}
+	if len(up) == 0 {
+		return ""
+	}
+	if total == 0 {
+		return up[rand.Intn(len(up))].url
+	}
+	n := rand.Intn(total)
+	for _, u := range up {
+		if n -= u.weight; n < 0 {
+			return u.url
+		}
+	}
+	return ""
+}
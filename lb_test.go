@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSplitWeight(t *testing.T) {
+	for item, want := range map[string]struct {
+		backend string
+		weight  int
+	}{
+		":80":                      {":80", 1},
+		"http://a:80@3":            {"http://a:80", 3},
+		" 10.0.0.1:8080@0 ":        {"10.0.0.1:8080", 0},
+		"http://user:pass@a:80":    {"http://user:pass@a:80", 1},
+		"http://user:pass@a:80@2":  {"http://user:pass@a:80", 2},
+		"http://user@a/prefix":     {"http://user@a/prefix", 1},
+		"http://user@a.test:80@10": {"http://user@a.test:80", 10},
+	} {
+		if backend, weight := splitWeight(item); backend != want.backend || weight != want.weight {
+			t.Errorf("splitWeight(%q) = %q, %d, want %q, %d", item, backend, weight, want.backend, want.weight)
+		}
+	}
+}
+
+func TestParsePoolWeights(t *testing.T) {
+	pool := parsePool("http://a:80@3|b:81")
+	if len(pool.upstreams) != 2 {
+		t.Fatalf("got %d backends", len(pool.upstreams))
+	}
+	for i, want := range []struct {
+		url    string
+		weight int
+	}{{"http://a:80", 3}, {"http://b:81", 1}} {
+		if u := pool.upstreams[i]; u.url != want.url || u.weight != want.weight {
+			t.Errorf("backend %d: %s@%d, want %s@%d", i, u.url, u.weight, want.url, want.weight)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	gz "compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the timestamp of the rotated log files
+const logBackupTime = "2006-01-02T15-04-05.000"
+
+// a log file rotated once it reaches -log-max-size,
+// the rotated files are gzipped with -log-compress and removed
+// past -log-max-backups or -log-max-age by a single background goroutine .
+type rotatingFile struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+	mill chan struct{}
+}
+
+// open the specified log file for appending, its rotated files are cleaned up already
+func openRotatingFile(path string) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, mill: make(chan struct{}, 1)}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	go f.millRun()
+	f.mill <- struct{}{}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if max := int64(*logMaxSize) << 20; max > 0 && f.size > 0 && f.size+int64(len(b)) > max {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// move the current file aside and start a new one, the lock is held
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	ext := filepath.Ext(f.path)
+	backup := strings.TrimSuffix(f.path, ext) + "-" + time.Now().Format(logBackupTime) + ext
+	if err := os.Rename(f.path, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	select {
+	case f.mill <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// compress and remove the rotated files off the write path, one run at a time
+func (f *rotatingFile) millRun() {
+	for range f.mill {
+		kept := 0
+		for _, backup := range f.backups() {
+			info, err := os.Stat(backup)
+			if err != nil {
+				continue
+			}
+			if (*logMaxBackups > 0 && kept >= *logMaxBackups) || (*logMaxAge > 0 && time.Since(info.ModTime()) > *logMaxAge) {
+				os.Remove(backup)
+				continue
+			}
+			kept++
+			if *logCompress && !strings.HasSuffix(backup, ".gz") {
+				if err := compressFile(backup); err != nil {
+					// logging to ourselves could rotate again, stderr it is
+					os.Stderr.WriteString("-log-compress: " + err.Error() + "\n")
+				}
+			}
+		}
+	}
+}
+
+// the rotated files of the log, the newest first, the files matching the glob whose
+// timestamp isn't one rotate writes are someone else's, e.g. an -audit-log next to it .
+func (f *rotatingFile) backups() []string {
+	ext := filepath.Ext(f.path)
+	base := strings.TrimSuffix(f.path, ext) + "-"
+	matches, _ := filepath.Glob(base + "*" + ext + "*")
+	backups := []string{}
+	for _, match := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(match, base), ".gz")
+		if !strings.HasSuffix(stamp, ext) {
+			continue
+		}
+		if _, err := time.Parse(logBackupTime, strings.TrimSuffix(stamp, ext)); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// the timestamps sort as strings
+	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	return backups
+}
+
+// gzip the specified file into file.gz and remove it
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gz.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		out.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// send the log to -log-file when set, and return where the access log goes
+func setupLog() io.Writer {
+	if *logFile == "" {
+		return os.Stderr
+	}
+	f, err := openRotatingFile(*logFile)
+	if err != nil {
+		log.Fatalf("-log-file: %v", err)
+	}
+	log.SetOutput(f)
+	return f
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRotatingFileBackups(t *testing.T) {
+	for _, name := range []string{"httpsify", "httpsify.log"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			ext := filepath.Ext(name)
+			base := strings.TrimSuffix(name, ext)
+			want := []string{
+				base + "-2026-10-14T06-00-00.000" + ext + ".gz",
+				base + "-2026-10-14T05-00-00.000" + ext,
+			}
+			others := []string{name, base + "-audit", base + "-audit" + ext, base + "-2026-10-14" + ext, base + "-old" + ext + ".gz"}
+			for _, file := range append(append([]string{}, want...), others...) {
+				if err := os.WriteFile(filepath.Join(dir, file), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			f := &rotatingFile{path: filepath.Join(dir, name)}
+			got := []string{}
+			for _, backup := range f.backups() {
+				got = append(got, filepath.Base(backup))
+			}
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Fatalf("got the backups %q, want %q", got, want)
+			}
+		})
+	}
+}
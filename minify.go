@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/tdewolff/minify"
+)
+
+// minify the responses like the minify middleware does, but remember the
+// minified result of each body so identical responses are minified only once .
+// HEAD responses pass through, their empty body would replace the Content-Length .
+func minifyCacheHandler(m *minify.M, cache *lru, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		bw := newBufferedWriter(w, func(code int, hdr http.Header) bool {
+			mediatype, _, _ := mime.ParseMediaType(hdr.Get("Content-Type"))
+			_, _, minifier := m.Match(mediatype)
+			return code == http.StatusOK && minifier != nil && hdr.Get("Content-Encoding") == ""
+		})
+		h.ServeHTTP(bw, r)
+		body, ok := bw.body()
+		if !ok {
+			return
+		}
+		contentType := w.Header().Get("Content-Type")
+		// the content type is part of the key since it picks the minifier and its params
+		sum := sha256.Sum256(append([]byte(contentType+"\x00"), body...))
+		key := string(sum[:])
+		if cached, found := cache.get(key); found {
+			body = cached.([]byte)
+		} else {
+			mediatype, _, _ := mime.ParseMediaType(contentType)
+			minified := &bytes.Buffer{}
+			if err := m.Minify(mediatype, minified, bytes.NewReader(body)); err == nil {
+				body = minified.Bytes()
+				cache.add(key, body, int64(len(body)))
+			}
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(bw.code)
+		w.Write(body)
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// how long browsers keep the network error logging policy, in seconds
+const nelMaxAge = 86400
+
+// the report collector url of each domain with network error logging enabled
+var domain_nel = map[string]string{}
+
+// parse the -nel flag, a domain without a collector reports to the built-in endpoint
+func parseNel(s string) {
+	for domain, collector := range parseZones(s) {
+		if collector == "" {
+			if *nelReportPath == "" {
+				log.Fatalf("-nel: %s has no collector and -nel-report-path isn't set", domain)
+			}
+			collector = "https://" + domain + *nelReportPath
+		}
+		domain_nel[domain] = collector
+	}
+}
+
+// add the NEL and Report-To headers of the specified domain
+func setNelHeaders(domain string, h http.Header) {
+	collector, found := domain_nel[domain]
+	if !found {
+		return
+	}
+	reportTo, _ := json.Marshal(map[string]interface{}{
+		"group":     "network-errors",
+		"max_age":   nelMaxAge,
+		"endpoints": []map[string]string{{"url": collector}},
+	})
+	nel, _ := json.Marshal(map[string]interface{}{
+		"report_to": "network-errors",
+		"max_age":   nelMaxAge,
+	})
+	h.Set("Report-To", string(reportTo))
+	h.Set("NEL", string(nel))
+}
+
+// the built-in report ingestion endpoint, it just logs the received reports
+func nelReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	report, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("%s: nel report from %s: %s", r.Host, r.RemoteAddr, report)
+	w.WriteHeader(http.StatusNoContent)
+}
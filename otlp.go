@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the spans waiting to be exported, they are dropped when the queue is full
+var (
+	otlpSpans   = make(chan map[string]interface{}, 4096)
+	otlpDropped = expvar.NewInt("otlp_dropped_spans")
+	// a hung collector must not stall the export of the following batches
+	otlpClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// export a span per request to the -otlp-endpoint collector,
+// the export is batched in the background so it never delays the responses .
+func otlpHandler(h http.Handler) http.Handler {
+	go exportSpans(strings.TrimRight(*otlpEndpoint, "/") + "/v1/traces")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		span := requestSpan(r, sw.code, start, time.Now())
+		select {
+		case otlpSpans <- span:
+		default:
+			otlpDropped.Add(1)
+		}
+	})
+}
+
+// the otlp/json span of the specified request,
+// it joins the trace of the incoming traceparent header if any .
+func requestSpan(r *http.Request, code int, start, end time.Time) map[string]interface{} {
+	traceID, parentID := randomHex(16), ""
+	if parts := strings.Split(r.Header.Get("Traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID, parentID = parts[1], parts[2]
+	}
+	status := 0
+	if code >= 500 {
+		status = 2
+	}
+	return map[string]interface{}{
+		"traceId":           traceID,
+		"spanId":            randomHex(8),
+		"parentSpanId":      parentID,
+		"name":              r.Method,
+		"kind":              2,
+		"startTimeUnixNano": strconv.FormatInt(start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes": []map[string]interface{}{
+			otlpAttribute("http.request.method", "stringValue", r.Method),
+			otlpAttribute("server.address", "stringValue", r.Host),
+			otlpAttribute("url.path", "stringValue", r.URL.Path),
+			otlpAttribute("client.address", "stringValue", clientIP(r)),
+			otlpAttribute("http.response.status_code", "intValue", strconv.Itoa(code)),
+		},
+		"status": map[string]int{"code": status},
+	}
+}
+
+// an otlp/json key value attribute
+func otlpAttribute(key, kind, value string) map[string]interface{} {
+	return map[string]interface{}{"key": key, "value": map[string]string{kind: value}}
+}
+
+// n random bytes hex encoded
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// send the queued spans in batches of up to 512, or every 5 seconds
+func exportSpans(endpoint string) {
+	batch := []map[string]interface{}{}
+	ticker := time.NewTicker(5 * time.Second)
+	for {
+		select {
+		case span := <-otlpSpans:
+			if batch = append(batch, span); len(batch) < 512 {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		postSpans(endpoint, batch)
+		batch = []map[string]interface{}{}
+	}
+}
+
+// post a batch of spans to the collector
+func postSpans(endpoint string, spans []map[string]interface{}) {
+	payload, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": []map[string]interface{}{otlpAttribute("service.name", "stringValue", "httpsify")},
+			},
+			"scopeSpans": []map[string]interface{}{{
+				"scope": map[string]string{"name": "httpsify"},
+				"spans": spans,
+			}},
+		}},
+	})
+	res, err := otlpClient.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		log.Printf("otlp: %v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		log.Printf("otlp: %s answered %s", endpoint, res.Status)
+	}
+}
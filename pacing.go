@@ -0,0 +1,72 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// the connections currently writing, they share -total-egress-rate
+var egressWriters int64
+
+func init() {
+	expvar.Publish("egress_writers", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&egressWriters)
+	}))
+	expvar.Publish("egress_rate_per_writer", expvar.Func(func() interface{} {
+		return egressAllocation()
+	}))
+}
+
+// the bytes per second each writing connection may send right now
+func egressAllocation() int64 {
+	writers := atomic.LoadInt64(&egressWriters)
+	if writers < 1 {
+		writers = 1
+	}
+	return int64(*totalEgressRate) / writers
+}
+
+// a listener whose connections share the -total-egress-rate budget fairly
+type pacedListener struct {
+	net.Listener
+}
+
+func (l pacedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return pacedConn{c}, nil
+}
+
+// a connection whose writes are paced at its share of the egress budget,
+// the share is recomputed for every chunk so it follows the connections
+// starting and finishing their writes .
+type pacedConn struct {
+	net.Conn
+}
+
+func (c pacedConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(&egressWriters, 1)
+	defer atomic.AddInt64(&egressWriters, -1)
+	written := 0
+	for written < len(b) {
+		chunk := b[written:min(written+16<<10, len(b))]
+		start := time.Now()
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		rate := egressAllocation()
+		if rate < 1 {
+			rate = 1
+		}
+		if wait := time.Duration(int64(n)*int64(time.Second)/rate) - time.Since(start); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// the priority tiers of the requests, the lower ones are shed first under load
+const (
+	tierLow = iota
+	tierNormal
+	tierHigh
+)
+
+var tierNames = []string{"low", "normal", "high"}
+
+// a request classification rule of -qos
+type qosRule struct {
+	kind  string // path, method or header
+	name  string
+	value string
+	tier  int
+}
+
+var (
+	// the classification rules, not tiered requests are normal ones
+	qosRules []qosRule
+	// the requests being served under -max-concurrent
+	qosInflight int64
+	// the requests shed per tier
+	qosShed = expvar.NewMap("qos_shed")
+)
+
+func init() {
+	expvar.Publish("qos_inflight", expvar.Func(func() interface{} {
+		return atomic.LoadInt64(&qosInflight)
+	}))
+}
+
+// parse the -qos flag of path:/prefix->tier, method:METHOD->tier, header:Name->tier or header:Name=substring->tier
+func parseQoS(s string) {
+	for rule, tier := range parseZones(s) {
+		kind, match, _ := strings.Cut(rule, ":")
+		r := qosRule{kind: strings.ToLower(kind), tier: -1}
+		for i, name := range tierNames {
+			if strings.EqualFold(tier, name) {
+				r.tier = i
+			}
+		}
+		switch r.kind {
+		case "path":
+			r.value = match
+		case "method":
+			r.value = strings.ToUpper(match)
+		case "header":
+			r.name, r.value, _ = strings.Cut(match, "=")
+		default:
+			r.tier = -1
+		}
+		if r.tier < 0 || match == "" {
+			log.Fatalf("-qos: %s->%s: want path:/prefix, method:METHOD or header:Name[=substring] -> low, normal or high", rule, tier)
+		}
+		qosRules = append(qosRules, r)
+	}
+	if len(qosRules) > 0 && *maxConcurrent <= 0 {
+		log.Fatal("-qos requires -max-concurrent")
+	}
+	if *qosLowThreshold > *qosNormalThreshold || *qosNormalThreshold > 100 {
+		log.Fatal("want -qos-low-threshold <= -qos-normal-threshold <= 100")
+	}
+}
+
+func (rule qosRule) matches(r *http.Request) bool {
+	switch rule.kind {
+	case "path":
+		return strings.HasPrefix(r.URL.Path, rule.value)
+	case "method":
+		return r.Method == rule.value
+	}
+	value, found := r.Header[http.CanonicalHeaderKey(rule.name)]
+	return found && (rule.value == "" || strings.Contains(strings.Join(value, ","), rule.value))
+}
+
+// the tier of the request, the highest tier of the matching rules
+func tierOf(r *http.Request) int {
+	tier, matched := tierNormal, false
+	for _, rule := range qosRules {
+		if rule.matches(r) && (!matched || rule.tier > tier) {
+			tier, matched = rule.tier, true
+		}
+	}
+	return tier
+}
+
+// admit the request under -max-concurrent, the low tier requests are shed past -qos-low-threshold percent of it,
+// the normal ones past -qos-normal-threshold and the high ones at the limit .
+// the admitted requests must call the returned release func, the websockets aren't counted .
+func admitQoS(r *http.Request) (release func(), admitted bool) {
+	if *maxConcurrent <= 0 || r.Header.Get("Upgrade") != "" {
+		return func() {}, true
+	}
+	tier := tierOf(r)
+	limit := int64(*maxConcurrent)
+	switch tier {
+	case tierLow:
+		limit = limit * int64(*qosLowThreshold) / 100
+	case tierNormal:
+		limit = limit * int64(*qosNormalThreshold) / 100
+	}
+	if atomic.AddInt64(&qosInflight, 1) > limit {
+		atomic.AddInt64(&qosInflight, -1)
+		qosShed.Add(tierNames[tier], 1)
+		return nil, false
+	}
+	return func() { atomic.AddInt64(&qosInflight, -1) }, true
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the status answered once a domain used up its bandwidth quota with -bandwidth-action block
+const statusBandwidthLimitExceeded = 509
+
+// the egress of a domain within the current period
+type bandwidthUsage struct {
+	mu     sync.Mutex
+	quota  int64
+	Used   int64     `json:"used"`
+	Period time.Time `json:"period"`
+}
+
+// the bandwidth usage of each domain with a quota
+var domain_bandwidth = map[string]*bandwidthUsage{}
+
+// parse a byte size with an optional K, M, G or T binary suffix
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	shift := 0
+	if i := strings.IndexAny(s, "KMGT"); i >= 0 && i == len(s)-1 {
+		shift = 10 * (1 + strings.IndexByte("KMGT", s[i]))
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return n << shift, nil
+}
+
+// the start of the -bandwidth-period the specified time falls in
+func periodOf(t time.Time) time.Time {
+	t = t.UTC()
+	if *bandwidthPeriod == "daily" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// parse the -bandwidth-quota flag of domain->size, load -bandwidth-state and start saving it
+func parseBandwidthQuotas(s string) {
+	for domain, size := range parseZones(s) {
+		quota, err := parseByteSize(size)
+		if err != nil {
+			log.Fatalf("-bandwidth-quota: %s: %v %q", domain, err, size)
+		}
+		domain_bandwidth[domain] = &bandwidthUsage{quota: quota, Period: periodOf(time.Now())}
+	}
+	if len(domain_bandwidth) == 0 {
+		return
+	}
+	if *bandwidthPeriod != "daily" && *bandwidthPeriod != "monthly" {
+		log.Fatalf("-bandwidth-period: %s: want daily or monthly", *bandwidthPeriod)
+	}
+	if *bandwidthAction != "block" && *bandwidthAction != "throttle" {
+		log.Fatalf("-bandwidth-action: %s: want block or throttle", *bandwidthAction)
+	}
+	if *bandwidthThrottle <= 0 {
+		log.Fatal("-bandwidth-throttle-rate must be positive")
+	}
+	if *bandwidthState != "" {
+		loadBandwidthState()
+		go func() {
+			for range time.Tick(time.Minute) {
+				saveBandwidthState()
+			}
+		}()
+	}
+	expvar.Publish("bandwidth", expvar.Func(bandwidthStats))
+}
+
+// restore the usage of the current period from -bandwidth-state
+func loadBandwidthState() {
+	data, err := os.ReadFile(*bandwidthState)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("-bandwidth-state: %v", err)
+	}
+	saved := map[string]*bandwidthUsage{}
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Fatalf("-bandwidth-state: %v", err)
+	}
+	for domain, usage := range domain_bandwidth {
+		if s, found := saved[domain]; found && s.Period.Equal(usage.Period) {
+			usage.Used = s.Used
+		}
+	}
+}
+
+// write the usage to -bandwidth-state, through a rename so a crash never leaves half a file
+func saveBandwidthState() {
+	data, err := json.Marshal(bandwidthSnapshot())
+	if err == nil {
+		tmp := *bandwidthState + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, *bandwidthState)
+		}
+	}
+	if err != nil {
+		log.Printf("-bandwidth-state: %v", err)
+	}
+}
+
+// a copy of the usage of each domain
+func bandwidthSnapshot() map[string]*bandwidthUsage {
+	snapshot := map[string]*bandwidthUsage{}
+	for domain, usage := range domain_bandwidth {
+		usage.mu.Lock()
+		usage.rollover()
+		snapshot[domain] = &bandwidthUsage{quota: usage.quota, Used: usage.Used, Period: usage.Period}
+		usage.mu.Unlock()
+	}
+	return snapshot
+}
+
+// the usage and quota of each domain
+func bandwidthStats() interface{} {
+	stats := map[string]interface{}{}
+	for domain, usage := range bandwidthSnapshot() {
+		stats[domain] = map[string]interface{}{"used": usage.Used, "quota": usage.quota, "period": usage.Period}
+	}
+	return stats
+}
+
+// start a new period once the current one is over, the lock is held
+func (u *bandwidthUsage) rollover() {
+	if period := periodOf(time.Now()); !period.Equal(u.Period) {
+		u.Period, u.Used = period, 0
+	}
+}
+
+// account the bytes sent and tell whether the quota is used up
+func (u *bandwidthUsage) add(n int64) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover()
+	u.Used += n
+	return u.Used >= u.quota
+}
+
+// whether the quota of the period is used up
+func (u *bandwidthUsage) exceeded() bool {
+	return u.add(0)
+}
+
+// a response writer accounting its bytes to the usage of its domain,
+// throttled to -bandwidth-throttle-rate once the quota is used up with -bandwidth-action throttle .
+type quotaWriter struct {
+	http.ResponseWriter
+	usage *bandwidthUsage
+}
+
+func (qw quotaWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b
+		throttled := *bandwidthAction == "throttle" && qw.usage.exceeded()
+		if throttled && len(chunk) > *bandwidthThrottle {
+			chunk = chunk[:*bandwidthThrottle]
+		}
+		n, err := qw.ResponseWriter.Write(chunk)
+		written += n
+		qw.usage.add(int64(n))
+		if err != nil {
+			return written, err
+		}
+		if throttled {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(*bandwidthThrottle))
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (qw quotaWriter) Flush() {
+	if f, ok := qw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// hijacking is passed through for the websocket proxy, whose frames aren't accounted
+func (qw quotaWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := qw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("webserver doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// enforce the bandwidth quota of the domains, it sits outside the compression so the accounted
+// bytes are the ones actually sent, the requests of a used up quota are answered 509 with -bandwidth-action block .
+func bandwidthHandler(h http.Handler) http.Handler {
+	if len(domain_bandwidth) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		usage, found := domain_bandwidth[hostOf(r.Host)]
+		if !found {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if *bandwidthAction == "block" && usage.exceeded() {
+			http.Error(w, "Bandwidth Limit Exceeded", statusBandwidthLimitExceeded)
+			return
+		}
+		h.ServeHTTP(quotaWriter{w, usage}, r)
+	})
+}
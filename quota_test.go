@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthQuotaCountsCompressedBytes(t *testing.T) {
+	defer func(saved map[string]*bandwidthUsage) { domain_bandwidth = saved }(domain_bandwidth)
+	usage := &bandwidthUsage{quota: 1 << 30, Period: periodOf(time.Now())}
+	domain_bandwidth = map[string]*bandwidthUsage{"a.test": usage}
+	body := strings.Repeat("compressible ", 1000)
+	h := bandwidthHandler(compressTypesHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}), 6, nil, nil))
+	r := httptest.NewRequest("GET", "https://a.test:443/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	if rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal("the response wasn't compressed")
+	}
+	if usage.Used != int64(rec.Body.Len()) {
+		t.Fatalf("accounted %d bytes, sent %d", usage.Used, rec.Body.Len())
+	}
+}
+
+func TestBandwidthQuotaBlock(t *testing.T) {
+	defer func(saved map[string]*bandwidthUsage, action string) {
+		domain_bandwidth, *bandwidthAction = saved, action
+	}(domain_bandwidth, *bandwidthAction)
+	*bandwidthAction = "block"
+	domain_bandwidth = map[string]*bandwidthUsage{"a.test": {quota: 10, Used: 10, Period: periodOf(time.Now())}}
+	h := bandwidthHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("the request of a used up quota was served")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "https://a.test/", nil))
+	if rec.Code != statusBandwidthLimitExceeded {
+		t.Fatalf("got %d, want 509", rec.Code)
+	}
+}
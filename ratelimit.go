@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// the requests of each client ip in the current window
+var requestCounter = &windowCounter{counts: map[string]int{}}
+
+// the tarpitted requests
+var (
+	tarpitted       = expvar.NewInt("tarpitted_requests")
+	tarpitSlots     chan struct{}
+	tarpitSlotsOnce sync.Once
+)
+
+// a fixed window counter
+type windowCounter struct {
+	mu     sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// count a hit of the specified key, it returns the hits of the current window
+// and the time left before the window resets .
+func (c *windowCounter) hit(key string, window time.Duration) (int, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.Sub(c.start) >= window {
+		c.start, c.counts = now, map[string]int{}
+	}
+	c.counts[key]++
+	return c.counts[key], window - now.Sub(c.start)
+}
+
+// enforce -rate-limit and -tarpit-threshold on the specified request,
+// it returns false when the request has been answered .
+// clients over the tarpit threshold get their answer only after -tarpit-delay,
+// at most -tarpit-max of them at once, the extra ones are just disconnected .
+func rateLimit(w http.ResponseWriter, r *http.Request) bool {
+	if *rateLimitMax < 1 && *tarpitThreshold < 1 {
+		return true
+	}
+	hits, left := requestCounter.hit(clientIP(r), *rateWindow)
+	if *tarpitThreshold > 0 && hits > *tarpitThreshold {
+		tarpitSlotsOnce.Do(func() { tarpitSlots = make(chan struct{}, *tarpitMax) })
+		select {
+		case tarpitSlots <- struct{}{}:
+		default:
+			panic(http.ErrAbortHandler)
+		}
+		defer func() { <-tarpitSlots }()
+		tarpitted.Add(1)
+		select {
+		case <-time.After(*tarpitDelay):
+		case <-r.Context().Done():
+			return false
+		}
+		rateLimited(w, r, left)
+		return false
+	}
+	if *rateLimitMax > 0 && hits > *rateLimitMax {
+		rateLimited(w, r, left)
+		return false
+	}
+	return true
+}
+
+// a custom rate limited response
+type rateLimitResponse struct {
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers"`
+	Body        string            `json:"body"`
+	body        *template.Template
+}
+
+// the custom rate limited response of each domain
+var domain_rate_limit_response = map[string]*rateLimitResponse{}
+
+// load the -rate-limit-responses json file of domain: {status, content_type, headers, body},
+// the body is a text/template given the {{.RetryAfter}} seconds .
+func loadRateLimitResponses() {
+	if *rateLimitResponses == "" {
+		return
+	}
+	data, err := os.ReadFile(*rateLimitResponses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &domain_rate_limit_response); err != nil {
+		log.Fatalf("%s: %v", *rateLimitResponses, err)
+	}
+	for domain, res := range domain_rate_limit_response {
+		if res.Status == 0 {
+			res.Status = http.StatusTooManyRequests
+		}
+		if res.body, err = template.New(domain).Parse(res.Body); err != nil {
+			log.Fatalf("%s: %s: %v", *rateLimitResponses, domain, err)
+		}
+	}
+}
+
+// answer a rate limited request, with the custom response of its domain if any
+func rateLimited(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	seconds := int(retryAfter.Seconds() + 0.5)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	res, found := domain_rate_limit_response[r.Host]
+	if !found {
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	for k, v := range res.Headers {
+		w.Header().Set(k, v)
+	}
+	if res.ContentType != "" {
+		w.Header().Set("Content-Type", res.ContentType)
+	}
+	w.WriteHeader(res.Status)
+	res.body.Execute(w, map[string]int{"RetryAfter": seconds})
+}
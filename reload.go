@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// what can be reloaded without a restart, its state is audited before and after each reload
+type reloader struct {
+	name   string
+	reload func() error
+	state  func() interface{}
+}
+
+// the reloaders run on SIGHUP
+var reloaders []reloader
+
+// run the reloaders on each SIGHUP, a failed reload keeps the previous state
+func watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		log.Print("SIGHUP received, reloading")
+		for _, r := range reloaders {
+			entry := auditEntry{Action: "reload " + r.name, Principal: "signal", Source: "SIGHUP", Before: r.state()}
+			if err := r.reload(); err != nil {
+				log.Printf("reload: %v", err)
+				entry.Error = err.Error()
+			}
+			entry.After = r.state()
+			audit(entry)
+		}
+	}
+}
+
+// shut the server down gracefully on SIGTERM or SIGINT, the in flight requests get -shutdown-timeout
+// to finish then the websockets, which the server doesn't track once hijacked, are drained .
+func shutdownOnSignal(s *http.Server, drained chan<- struct{}) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	sig := <-stop
+	log.Printf("%s received, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	drainWebsockets()
+	if len(domain_bandwidth) > 0 && *bandwidthState != "" {
+		saveBandwidthState()
+	}
+	close(drained)
+}
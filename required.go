@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the request headers a domain requires and the status its requests lacking one get
+type requiredHeaders struct {
+	names  []string
+	status int
+}
+
+// the required request headers of each domain
+var domain_required_headers = map[string]requiredHeaders{}
+
+// parse the -required-headers flag of domain->Name|Name[|status=code], the status is -required-headers-status by default
+func parseRequiredHeaders(s string) {
+	for domain, list := range parseZones(s) {
+		required := requiredHeaders{status: *requiredStatus}
+		for _, item := range strings.Split(list, "|") {
+			item = strings.TrimSpace(item)
+			if code, found := strings.CutPrefix(item, "status="); found {
+				status, err := strconv.Atoi(code)
+				if err != nil || status < 400 || status > 599 {
+					log.Fatalf("-required-headers: %s: invalid status %q", domain, code)
+				}
+				required.status = status
+			} else if item != "" {
+				required.names = append(required.names, http.CanonicalHeaderKey(item))
+			}
+		}
+		domain_required_headers[domain] = required
+	}
+}
+
+// reject the request when it lacks a header its domain requires, it returns whether it may go on
+func checkRequiredHeaders(w http.ResponseWriter, r *http.Request) bool {
+	required, found := domain_required_headers[r.Host]
+	if !found {
+		return true
+	}
+	missing := []string{}
+	for _, name := range required.names {
+		if r.Header.Get(name) == "" {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return true
+	}
+	http.Error(w, "missing required request header: "+strings.Join(missing, ", "), required.status)
+	return false
+}
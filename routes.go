@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+)
+
+// the method groups usable in -method-routes
+var methodGroups = map[string][]string{
+	"read":  {http.MethodGet, http.MethodHead},
+	"write": {http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodPatch},
+}
+
+// the backend of each method of each domain
+var domain_method_backend = map[string]map[string]string{}
+
+// parse the -method-routes flag of domain->read=[ip]:port|write=[ip]:port|METHOD=[ip]:port
+func parseMethodRoutes(s string) {
+	for domain, routes := range parseZones(s) {
+		backends := map[string]string{}
+		for _, route := range strings.Split(routes, "|") {
+			parts := strings.SplitN(route, "=", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			methods, found := methodGroups[strings.ToLower(strings.TrimSpace(parts[0]))]
+			if !found {
+				methods = []string{strings.ToUpper(strings.TrimSpace(parts[0]))}
+			}
+			for _, method := range methods {
+				backends[method] = fixUrl(parts[1])
+			}
+		}
+		domain_method_backend[domain] = backends
+	}
+}
+
+// the backend of the request method, empty when there is no matching rule
+func methodBackend(r *http.Request) string {
+	return domain_method_backend[configuredDomain(r.Host)][r.Method]
+}
+
+// the backend of each negotiated alpn protocol of each domain
+var domain_alpn_backend = map[string]map[string]string{}
+
+// parse the -alpn-routes flag of domain->h2=[ip]:port|http/1.1=[ip]:port
+func parseALPNRoutes(s string) {
+	for domain, routes := range parseZones(s) {
+		backends := map[string]string{}
+		for _, route := range strings.Split(routes, "|") {
+			parts := strings.SplitN(route, "=", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			backends[strings.ToLower(strings.TrimSpace(parts[0]))] = fixUrl(parts[1])
+		}
+		domain_alpn_backend[domain] = backends
+	}
+}
+
+// the alpn protocol the client negotiated, http/1.1 when it negotiated none
+func negotiatedProtocol(r *http.Request) string {
+	if r.TLS == nil || r.TLS.NegotiatedProtocol == "" {
+		return "http/1.1"
+	}
+	return r.TLS.NegotiatedProtocol
+}
+
+// whether the request came over a tls-alpn-01 challenge connection,
+// those are autocert's business and must never be proxied .
+func acmeALPN(r *http.Request) bool {
+	return r.TLS != nil && r.TLS.NegotiatedProtocol == acme.ALPNProto
+}
+
+// the backend of the negotiated alpn protocol, empty when there is no matching rule
+func alpnBackend(r *http.Request) string {
+	return domain_alpn_backend[configuredDomain(r.Host)][negotiatedProtocol(r)]
+}
+
+// the methods a POST may be overridden with
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// the domains honoring X-HTTP-Method-Override
+var domain_method_override = map[string]bool{}
+
+// parse the -method-override flag of domains
+func parseMethodOverride(s string) {
+	for domain := range parseZones(s) {
+		domain_method_override[domain] = true
+	}
+}
+
+// turn a POST into the method of its X-HTTP-Method-Override header,
+// or of its _method query parameter with -method-override-query, neither goes upstream .
+// it returns false when the override isn't an allowed method .
+func overrideMethod(r *http.Request) bool {
+	if !domain_method_override[configuredDomain(r.Host)] {
+		return true
+	}
+	override := r.Header.Get("X-HTTP-Method-Override")
+	r.Header.Del("X-HTTP-Method-Override")
+	if *overrideQuery {
+		if query := r.URL.Query(); query.Has("_method") {
+			if override == "" {
+				override = query.Get("_method")
+			}
+			query.Del("_method")
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	if override == "" {
+		return true
+	}
+	override = strings.ToUpper(override)
+	if r.Method != http.MethodPost || !overridableMethods[override] {
+		return false
+	}
+	r.Method = override
+	return true
+}
+
+// the backend of each language tag of each domain, the "default" tag catches the other languages
+var domain_lang_backend = map[string]map[string]string{}
+
+// parse the -lang-routes flag of domain->en=[ip]:port|ja=[ip]:port|default=[ip]:port
+func parseLangRoutes(s string) {
+	for domain, routes := range parseZones(s) {
+		backends := map[string]string{}
+		for _, route := range strings.Split(routes, "|") {
+			parts := strings.SplitN(route, "=", 2)
+			if len(parts) < 2 {
+				continue
+			}
+			backends[strings.ToLower(strings.TrimSpace(parts[0]))] = fixUrl(parts[1])
+		}
+		domain_lang_backend[domain] = backends
+	}
+}
+
+// the language tags of the Accept-Language header of the request, the preferred first
+func acceptedLanguages(r *http.Request) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	langs := []weighted{}
+	for _, item := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(item, ";")
+		lang := weighted{strings.ToLower(strings.TrimSpace(tag)), 1}
+		if v, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			lang.q, _ = strconv.ParseFloat(v, 64)
+		}
+		if lang.tag != "" && lang.tag != "*" && lang.q > 0 {
+			langs = append(langs, lang)
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	tags := make([]string, len(langs))
+	for i, lang := range langs {
+		tags[i] = lang.tag
+	}
+	return tags
+}
+
+// the backend of the preferred language of the request, a tag like en-us matches an en rule,
+// it is the default backend when no language matches and empty when there is no rule at all .
+func langBackend(r *http.Request) string {
+	backends, found := domain_lang_backend[configuredDomain(r.Host)]
+	if !found {
+		return ""
+	}
+	for _, tag := range acceptedLanguages(r) {
+		if backend, found := backends[tag]; found {
+			return backend
+		}
+		if primary, _, found := strings.Cut(tag, "-"); found {
+			if backend, found := backends[primary]; found {
+				return backend
+			}
+		}
+	}
+	return backends["default"]
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// a request to a subdomain of the base domain a.test
+func subdomainRequest(t *testing.T, method string) *http.Request {
+	t.Helper()
+	backends, bases := domain_backend, baseDomains
+	t.Cleanup(func() { domain_backend, baseDomains = backends, bases })
+	domain_backend = map[string]string{"a.test": "http://127.0.0.1:1"}
+	baseDomains = []string{"a.test"}
+	r := httptest.NewRequest(method, "https://x.a.test/", nil)
+	r.Host = "x.a.test"
+	return r
+}
+
+func TestMethodRoutesOfSubdomain(t *testing.T) {
+	defer func(saved map[string]map[string]string) { domain_method_backend = saved }(domain_method_backend)
+	domain_method_backend = map[string]map[string]string{"a.test": {"POST": "http://127.0.0.1:2"}}
+	if got := methodBackend(subdomainRequest(t, "POST")); got != "http://127.0.0.1:2" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestALPNRoutesOfSubdomain(t *testing.T) {
+	defer func(saved map[string]map[string]string) { domain_alpn_backend = saved }(domain_alpn_backend)
+	domain_alpn_backend = map[string]map[string]string{"a.test": {"h2": "http://127.0.0.1:3"}}
+	r := subdomainRequest(t, "GET")
+	r.TLS = &tls.ConnectionState{NegotiatedProtocol: "h2"}
+	if got := alpnBackend(r); got != "http://127.0.0.1:3" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestMethodOverrideOfSubdomain(t *testing.T) {
+	defer func(saved map[string]bool) { domain_method_override = saved }(domain_method_override)
+	domain_method_override = map[string]bool{"a.test": true}
+	r := subdomainRequest(t, "POST")
+	r.Header.Set("X-HTTP-Method-Override", "DELETE")
+	if !overrideMethod(r) || r.Method != "DELETE" {
+		t.Fatalf("got %s", r.Method)
+	}
+}
+
+func TestLangRoutesOfSubdomain(t *testing.T) {
+	defer func(saved map[string]map[string]string) { domain_lang_backend = saved }(domain_lang_backend)
+	domain_lang_backend = map[string]map[string]string{"a.test": {"ja": "http://127.0.0.1:4"}}
+	r := subdomainRequest(t, "GET")
+	r.Header.Set("Accept-Language", "ja")
+	if got := langBackend(r); got != "http://127.0.0.1:4" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// the connections dropped for sending their request too slowly
+var (
+	slowDropped = expvar.NewInt("slow_connections_dropped")
+	errTooSlow  = errors.New("client too slow")
+)
+
+// the connection context key of the client connection
+type connKey struct{}
+
+// a listener enforcing -min-read-rate on its connections
+type minRateListener struct {
+	net.Listener
+}
+
+func (l minRateListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &minRateConn{Conn: c, reading: true}, nil
+}
+
+// a connection that must send at least -min-read-rate bytes per second
+// while a request is being read, once -min-read-rate-grace has passed .
+// the rate is enforced with a read deadline, so a client going silent is dropped too,
+// the deadline of the server is kept in deadline and applies when it is the earlier one .
+type minRateConn struct {
+	net.Conn
+	mu       sync.Mutex
+	reading  bool
+	start    time.Time
+	bytes    int64
+	deadline time.Time
+}
+
+func (c *minRateConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	enforced := false
+	deadline := c.deadline
+	if c.reading && !c.start.IsZero() {
+		// past the grace, the bytes read so far are enough till that time only
+		rateDeadline := c.start.Add(max(*minReadRateGrace, time.Duration(float64(c.bytes)/float64(*minReadRate)*float64(time.Second))))
+		if deadline.IsZero() || rateDeadline.Before(deadline) {
+			deadline, enforced = rateDeadline, true
+		}
+	}
+	// set under the lock so a deadline the server sets meanwhile isn't overwritten
+	c.Conn.SetReadDeadline(deadline)
+	c.mu.Unlock()
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if c.reading && n > 0 {
+		if c.start.IsZero() {
+			c.start = time.Now()
+		}
+		c.bytes += int64(n)
+	}
+	bytes, start := c.bytes, c.start
+	c.mu.Unlock()
+	if enforced && errors.Is(err, os.ErrDeadlineExceeded) {
+		slowDropped.Add(1)
+		log.Printf("%s: sent %d bytes in %s, below -min-read-rate, dropping", c.RemoteAddr(), bytes, time.Since(start).Round(time.Millisecond))
+		c.Conn.Close()
+		return n, errTooSlow
+	}
+	return n, err
+}
+
+func (c *minRateConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *minRateConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+// the request has been read, the rate isn't enforced till the next one
+func (c *minRateConn) requestRead() {
+	c.mu.Lock()
+	c.reading = false
+	c.mu.Unlock()
+}
+
+// wait for the next request, its rate is measured from its first byte
+func (c *minRateConn) awaitRequest() {
+	c.mu.Lock()
+	c.reading, c.start, c.bytes = true, time.Time{}, 0
+	c.mu.Unlock()
+}
+
+// the rate enforcing connection under the specified server connection, nil when there is none
+func minRateConnOf(c net.Conn) *minRateConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	mc, _ := c.(*minRateConn)
+	return mc
+}
+
+// hook the rate enforcement into the server connection lifecycle
+func enforceMinReadRate(s *http.Server) {
+	s.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		return context.WithValue(ctx, connKey{}, c)
+	}
+	s.ConnState = func(c net.Conn, state http.ConnState) {
+		if mc := minRateConnOf(c); mc != nil && state == http.StateIdle {
+			mc.awaitRequest()
+		}
+	}
+	h := s.Handler
+	s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, ok := r.Context().Value(connKey{}).(net.Conn); ok {
+			if mc := minRateConnOf(c); mc != nil {
+				mc.requestRead()
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
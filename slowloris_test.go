@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// a rate enforcing connection of 100 bytes per second after 100ms, and its client end
+func minRatePipe(t *testing.T) (*minRateConn, net.Conn) {
+	t.Helper()
+	rate, grace := *minReadRate, *minReadRateGrace
+	t.Cleanup(func() { *minReadRate, *minReadRateGrace = rate, grace })
+	*minReadRate, *minReadRateGrace = 100, 100*time.Millisecond
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close(); client.Close() })
+	return &minRateConn{Conn: server, reading: true}, client
+}
+
+func TestMinReadRateSilentClient(t *testing.T) {
+	c, client := minRatePipe(t)
+	go client.Write([]byte("G"))
+	b := make([]byte, 16)
+	if n, err := c.Read(b); n != 1 || err != nil {
+		t.Fatalf("read %d bytes: %v", n, err)
+	}
+	before := slowDropped.Value()
+	start := time.Now()
+	if _, err := c.Read(b); !errors.Is(err, errTooSlow) {
+		t.Fatalf("the silent client wasn't dropped: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the silent client was dropped after %s", elapsed)
+	}
+	if slowDropped.Value() != before+1 {
+		t.Fatal("slow_connections_dropped didn't grow")
+	}
+}
+
+func TestMinReadRateSteadyClient(t *testing.T) {
+	c, client := minRatePipe(t)
+	go func() {
+		for i := 0; i < 30; i++ {
+			client.Write([]byte("0123456789"))
+			time.Sleep(10 * time.Millisecond)
+		}
+		client.Close()
+	}()
+	b := make([]byte, 16)
+	for {
+		if _, err := c.Read(b); err != nil {
+			if errors.Is(err, errTooSlow) {
+				t.Fatal("the client sending fast enough was dropped")
+			}
+			return
+		}
+	}
+}
+
+func TestMinReadRateServerDeadline(t *testing.T) {
+	c, client := minRatePipe(t)
+	go client.Write([]byte("G"))
+	b := make([]byte, 16)
+	c.Read(b)
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := c.Read(b); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("the earlier server deadline didn't apply: %v", err)
+	}
+}
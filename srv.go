@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a backend discovered via dns srv records
+type srvBackend struct {
+	name    string
+	mu      sync.RWMutex
+	targets []*net.SRV
+}
+
+// create a srv backend for the specified record name,
+// it is resolved right away then periodically in the background .
+func newSrvBackend(name string) *srvBackend {
+	b := &srvBackend{name: name}
+	b.resolve()
+	go b.watch()
+	return b
+}
+
+// resolve the srv record, the previous targets are kept on failure
+func (b *srvBackend) resolve() {
+	_, targets, err := net.LookupSRV("", "", b.name)
+	if err != nil {
+		log.Printf("srv %s: %v", b.name, err)
+		return
+	}
+	b.mu.Lock()
+	b.targets = targets
+	b.mu.Unlock()
+}
+
+// re-resolve the srv record every -srv-interval
+func (b *srvBackend) watch() {
+	for range time.Tick(*srvInterval) {
+		b.resolve()
+	}
+}
+
+// pick a host:port target, honoring the priority then the weight as per rfc 2782,
+// it returns an empty string when there is no known target .
+func (b *srvBackend) pick() string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.targets) == 0 {
+		return ""
+	}
+	// the targets of the lowest priority, the resolver returns them sorted by priority
+	group, total := []*net.SRV{}, 0
+	for _, t := range b.targets {
+		if t.Priority != b.targets[0].Priority {
+			break
+		}
+		group = append(group, t)
+		total += int(t.Weight)
+	}
+	picked := group[rand.Intn(len(group))]
+	if total > 0 {
+		n := rand.Intn(total)
+		for _, t := range group {
+			if n -= int(t.Weight); n < 0 {
+				picked = t
+				break
+			}
+		}
+	}
+	return strings.TrimSuffix(picked.Target, ".") + ":" + strconv.Itoa(int(picked.Port))
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// a request timeout applied to a path prefix of a domain
+type timeoutTier struct {
+	prefix  string
+	timeout time.Duration
+}
+
+// the timeout tiers of each domain, the longest prefix first
+var domain_timeouts = map[string][]timeoutTier{}
+
+// parse the -timeouts flag of domain[/path-prefix]->duration
+func parseTimeouts(s string) {
+	for zone, value := range parseZones(s) {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("-timeouts: %s: %v", zone, err)
+		}
+		domain, prefix := zone, "/"
+		if i := strings.Index(zone, "/"); i >= 0 {
+			domain, prefix = zone[:i], zone[i:]
+		}
+		tiers := append(domain_timeouts[domain], timeoutTier{prefix, timeout})
+		for i := len(tiers) - 1; i > 0 && len(tiers[i].prefix) > len(tiers[i-1].prefix); i-- {
+			tiers[i], tiers[i-1] = tiers[i-1], tiers[i]
+		}
+		domain_timeouts[domain] = tiers
+	}
+}
+
+// the request timeout of the specified domain and path, zero means no timeout
+func timeoutOf(domain, path string) time.Duration {
+	for _, tier := range domain_timeouts[domain] {
+		if strings.HasPrefix(path, tier.prefix) {
+			return tier.timeout
+		}
+	}
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// a transformer returns the rewrite of the response body of the specified request,
+// or nil when it doesn't apply to that response .
+type transformer func(r *http.Request, h http.Header) func(body []byte) []byte
+
+// the registered transformers, applied in order
+var transformers []transformer
+
+// apply the transformers to the backend responses,
+// it sits before the minifier and the compression so they see the final body .
+func transformHandler(h http.Handler) http.Handler {
+	if len(transformers) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rewrites := []func([]byte) []byte{}
+		bw := newBufferedWriter(w, func(code int, hdr http.Header) bool {
+			if code != http.StatusOK || hdr.Get("Content-Encoding") != "" {
+				return false
+			}
+			for _, t := range transformers {
+				if rewrite := t(r, hdr); rewrite != nil {
+					rewrites = append(rewrites, rewrite)
+				}
+			}
+			return len(rewrites) > 0
+		})
+		h.ServeHTTP(bw, r)
+		body, ok := bw.body()
+		if !ok {
+			return
+		}
+		for _, rewrite := range rewrites {
+			body = rewrite(body)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(bw.code)
+		w.Write(body)
+	})
+}
+
+// the media type of the specified header
+func mediaTypeOf(h http.Header) string {
+	mediatype, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mediatype
+}
+
+// the injection sample rate in percent of each domain
+var domain_inject = map[string]float64{}
+
+// parse the -inject flag of domain->percent and register the injection transformer
+func parseInject(s string) {
+	for domain, rate := range parseZones(s) {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(rate, "%"), 64)
+		if rate == "" {
+			percent, err = 100, nil
+		}
+		if err != nil {
+			log.Fatalf("-inject: %s: %v", domain, err)
+		}
+		domain_inject[domain] = percent
+	}
+	if len(domain_inject) > 0 {
+		if *injectMarker == "" || *injectContent == "" {
+			log.Fatal("-inject requires both -inject-marker and -inject-content")
+		}
+		transformers = append(transformers, injectTransformer)
+	}
+}
+
+// insert -inject-content before or after the first -inject-marker of text responses
+func injectTransformer(r *http.Request, h http.Header) func([]byte) []byte {
+	percent, found := domain_inject[r.Host]
+	if !found || !strings.HasPrefix(mediaTypeOf(h), "text/") || rand.Float64()*100 >= percent {
+		return nil
+	}
+	return func(body []byte) []byte {
+		i := bytes.Index(bytes.ToLower(body), bytes.ToLower([]byte(*injectMarker)))
+		if i < 0 {
+			return body
+		}
+		if *injectAfter {
+			i += len(*injectMarker)
+		}
+		injected := make([]byte, 0, len(body)+len(*injectContent))
+		injected = append(injected, body[:i]...)
+		injected = append(injected, *injectContent...)
+		return append(injected, body[i:]...)
+	}
+}
+
+// the absolute link pattern of the canonical hosts of each domain
+var domain_relative_links = map[string]*regexp.Regexp{}
+
+// parse the -relative-links flag of domain->host|host and register the link transformer
+func parseRelativeLinks(s string) {
+	for domain, hosts := range parseZones(s) {
+		quoted := []string{}
+		for _, host := range strings.Split(hosts, "|") {
+			if host = strings.TrimSpace(host); host != "" {
+				quoted = append(quoted, regexp.QuoteMeta(host))
+			}
+		}
+		// the attribute, the scheme relative or absolute url of a listed host, its path, then the end of the url
+		domain_relative_links[domain] = regexp.MustCompile(`(?i)(\s(?:href|src|action)\s*=\s*["']?)(?:https?:)?//(?:` + strings.Join(quoted, "|") + `)(?::\d+)?(/[^"'\s>]*)?(["'\s>])`)
+	}
+	if len(domain_relative_links) > 0 {
+		transformers = append(transformers, relativeLinksTransformer)
+	}
+}
+
+// rewrite the href, src and action links to the canonical hosts of html responses as root relative links,
+// links to any other host are left alone .
+func relativeLinksTransformer(r *http.Request, h http.Header) func([]byte) []byte {
+	re, found := domain_relative_links[r.Host]
+	if !found || mediaTypeOf(h) != "text/html" {
+		return nil
+	}
+	return func(body []byte) []byte {
+		return re.ReplaceAllFunc(body, func(link []byte) []byte {
+			parts := re.FindSubmatch(link)
+			path := parts[2]
+			if len(path) == 0 {
+				path = []byte("/")
+			}
+			return append(append(append([]byte{}, parts[1]...), path...), parts[3]...)
+		})
+	}
+}
+
+// the script tags of html up to their closing tag, an unclosed one doesn't match and is left alone
+var scriptTag = regexp.MustCompile(`(?is)<script\b([^>]*)>(.*?)</script\s*>`)
+
+// the src attribute of a script tag
+var scriptSrc = regexp.MustCompile(`(?i)\ssrc\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+
+// the patterns of the scripts stripped from the html responses of each domain
+var domain_strip_scripts = map[string][]*regexp.Regexp{}
+
+// parse the -strip-scripts flag of domain->regexp|regexp and register the script transformer
+func parseStripScripts(s string) {
+	for domain, patterns := range parseZones(s) {
+		for _, pattern := range strings.Split(patterns, "|") {
+			if pattern = strings.TrimSpace(pattern); pattern == "" {
+				continue
+			}
+			re, err := regexp.Compile("(?i)" + pattern)
+			if err != nil {
+				log.Fatalf("-strip-scripts: %s: %v", domain, err)
+			}
+			domain_strip_scripts[domain] = append(domain_strip_scripts[domain], re)
+		}
+	}
+	if len(domain_strip_scripts) > 0 {
+		transformers = append(transformers, stripScriptsTransformer)
+	}
+}
+
+// remove the script tags of html responses whose src, or inline content when there is no src, matches a pattern
+func stripScriptsTransformer(r *http.Request, h http.Header) func([]byte) []byte {
+	patterns, found := domain_strip_scripts[r.Host]
+	if !found || mediaTypeOf(h) != "text/html" {
+		return nil
+	}
+	return func(body []byte) []byte {
+		return scriptTag.ReplaceAllFunc(body, func(tag []byte) []byte {
+			parts := scriptTag.FindSubmatch(tag)
+			subject := parts[2]
+			if src := scriptSrc.FindSubmatch(parts[1]); src != nil {
+				subject = bytes.Join(src[1:], nil)
+			}
+			for _, re := range patterns {
+				if re.Match(subject) {
+					return nil
+				}
+			}
+			return tag
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// the forward proxy each domain reaches its backends through
+var domain_via_proxy = map[string]*url.URL{}
+
+// the backend transport of each forward proxy, the tunneled connections are
+// pooled apart from the direct ones since a pool is keyed by backend address only .
+var viaProxyTransports = map[string]*http.Transport{}
+
+// parse the -backend-via-proxy flag of domain->http://[user:pass@]proxy:port
+func parseViaProxies(s string) {
+	for domain, value := range parseZones(s) {
+		proxy, err := url.Parse(value)
+		if err != nil || proxy.Host == "" {
+			log.Fatalf("-backend-via-proxy: %s: invalid proxy url %q", domain, value)
+		}
+		domain_via_proxy[domain] = proxy
+	}
+}
+
+// create the transport of each forward proxy once the backend transport is configured
+func setupViaProxies() {
+	for _, proxy := range domain_via_proxy {
+		if _, found := viaProxyTransports[proxy.String()]; found {
+			continue
+		}
+		t := transport.Clone()
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialTunnel(ctx, proxy, addr)
+		}
+		viaProxyTransports[proxy.String()] = t
+	}
+}
+
+// the transport reaching the backends of the specified domain, through its forward proxy if any
+func transportOf(domain string) *http.Transport {
+	if proxy, found := domain_via_proxy[domain]; found {
+		return viaProxyTransports[proxy.String()]
+	}
+	return transport
+}
+
+// dial the specified address through an http CONNECT tunnel, the handshake is bound by
+// the deadline of the context or else -connect-timeout, and cut short when the context is done .
+func dialTunnel(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	c, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+	} else if dialer.Timeout > 0 {
+		c.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { c.Close() })
+	c, err = handshakeTunnel(c, proxy, addr)
+	if !stop() {
+		if c != nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Time{})
+	return c, nil
+}
+
+// ask the proxy for a tunnel to the specified address over the connection, which is closed on failure
+func handshakeTunnel(c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s refused the tunnel to %s: %s", proxy.Host, addr, res.Status)
+	}
+	return &bufferedConn{c, br}, nil
+}
+
+// a connection whose reads go through the reader that consumed the tunnel response
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.br.Read(b)
+}
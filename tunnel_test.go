@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// a proxy that accepts connections and never answers
+func silentProxy(t *testing.T) *url.URL {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { c.Close() })
+		}
+	}()
+	return &url.URL{Scheme: "http", Host: ln.Addr().String()}
+}
+
+func TestDialTunnelSilentProxy(t *testing.T) {
+	proxy := silentProxy(t)
+	for name, cancelled := range map[string]bool{"deadline": false, "cancel": true} {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			if cancelled {
+				ctx, cancel = context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+			start := time.Now()
+			if c, err := dialTunnel(ctx, proxy, "backend.test:80"); err == nil {
+				c.Close()
+				t.Fatal("the tunnel was dialed through a proxy that never answered")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Fatalf("the dial gave up after %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestDialTunnelDefaultTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { dialer.Timeout = timeout }(dialer.Timeout)
+	dialer.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	if _, err := dialTunnel(context.Background(), silentProxy(t), "backend.test:80"); err == nil {
+		t.Fatal("the tunnel was dialed through a proxy that never answered")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the dial gave up after %s", elapsed)
+	}
+}
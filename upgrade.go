@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// the environment variable telling an upgraded process its inherited sockets, e.g. listen=3,admin=4
+	upgradeFDsEnv = "HTTPSIFY_UPGRADE_FDS"
+	// the environment variable telling an upgraded process the pid of the process it replaces
+	upgradeParentEnv = "HTTPSIFY_UPGRADE_PARENT"
+)
+
+// the sockets handed over to the next process on SIGUSR2, by name
+var (
+	upgradeMu      sync.Mutex
+	upgradeSockets = map[string]interface{ File() (*os.File, error) }{}
+)
+
+// the file descriptor of each socket inherited from the process we replace
+func inheritedFDs() map[string]int {
+	fds := map[string]int{}
+	for _, item := range splitList(os.Getenv(upgradeFDsEnv)) {
+		name, value, _ := strings.Cut(item, "=")
+		if fd, err := strconv.Atoi(value); err == nil {
+			fds[name] = fd
+		}
+	}
+	return fds
+}
+
+// register a socket to hand over on upgrade
+func handOver(name string, socket interface{ File() (*os.File, error) }) {
+	upgradeMu.Lock()
+	upgradeSockets[name] = socket
+	upgradeMu.Unlock()
+}
+
+// the named tcp listener, inherited from the process we replace when there is one,
+// otherwise created by listen, either way it is handed over to the next process on upgrade .
+func listenUpgradable(name, addr string, listen func(addr string) net.Listener) net.Listener {
+	var ln net.Listener
+	if fd, found := inheritedFDs()[name]; found {
+		f := os.NewFile(uintptr(fd), name)
+		var err error
+		if ln, err = net.FileListener(f); err != nil {
+			log.Fatalf("inherited %s listener: %v", name, err)
+		}
+		f.Close()
+	} else {
+		ln = listen(addr)
+	}
+	if tcp, ok := ln.(*net.TCPListener); ok {
+		handOver(name, tcp)
+	}
+	return ln
+}
+
+// the named udp socket, inherited or bound like listenUpgradable
+func listenPacketUpgradable(name, addr string) net.PacketConn {
+	var conn net.PacketConn
+	var err error
+	if fd, found := inheritedFDs()[name]; found {
+		f := os.NewFile(uintptr(fd), name)
+		conn, err = net.FilePacketConn(f)
+		f.Close()
+	} else {
+		conn, err = net.ListenPacket("udp", addr)
+	}
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	if udp, ok := conn.(*net.UDPConn); ok {
+		handOver(name, udp)
+	}
+	return conn
+}
+
+// tell the process we replace that we are serving, it then shuts down gracefully
+func upgradeReady() {
+	if pid, err := strconv.Atoi(os.Getenv(upgradeParentEnv)); err == nil {
+		log.Printf("upgraded, asking the previous process %d to drain", pid)
+		syscall.Kill(pid, syscall.SIGTERM)
+	}
+}
+
+// start a new process of the current executable on each SIGUSR2, handing it the sockets,
+// it tells us to drain once it serves, a new process that fails to start or exits before
+// leaves us serving as if nothing happened .
+func watchUpgrade() {
+	usr2 := make(chan os.Signal, 1)
+	signal.Notify(usr2, syscall.SIGUSR2)
+	for range usr2 {
+		log.Print("SIGUSR2 received, upgrading")
+		entry := auditEntry{Action: "upgrade", Principal: "signal", Source: "SIGUSR2", Before: os.Getpid()}
+		pid, err := upgrade()
+		if err != nil {
+			log.Printf("upgrade: %v, keeping on serving", err)
+			entry.Error = err.Error()
+		} else {
+			entry.After = pid
+		}
+		audit(entry)
+	}
+}
+
+// fork exec the current executable with the sockets, it returns the pid of the new process
+func upgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	upgradeMu.Lock()
+	names := []string{}
+	for name := range upgradeSockets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files, fds := []*os.File{}, []string{}
+	for _, name := range names {
+		f, err := upgradeSockets[name].File()
+		if err != nil {
+			upgradeMu.Unlock()
+			return 0, fmt.Errorf("%s: %v", name, err)
+		}
+		defer f.Close()
+		// the extra files start at fd 3, after stdin, stdout and stderr
+		fds = append(fds, name+"="+strconv.Itoa(3+len(files)))
+		files = append(files, f)
+	}
+	upgradeMu.Unlock()
+	env := []string{}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, upgradeFDsEnv+"=") && !strings.HasPrefix(v, upgradeParentEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(env, upgradeFDsEnv+"="+strings.Join(fds, ","), upgradeParentEnv+"="+strconv.Itoa(os.Getpid()))
+	cmd.Stdout, cmd.Stderr, cmd.ExtraFiles = os.Stdout, os.Stderr, files
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	go func() {
+		err := cmd.Wait()
+		log.Printf("upgraded process %d exited: %v", cmd.Process.Pid, err)
+	}()
+	return cmd.Process.Pid, nil
+}
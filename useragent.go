@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// a user agent rule of the -ua-rules file
+type uaRule struct {
+	domain string
+	allow  bool
+	re     *regexp.Regexp
+}
+
+// the loaded user agent rules
+var (
+	uaRulesMu sync.RWMutex
+	uaRules   []uaRule
+)
+
+// load the -ua-rules file, each line is "<domain|*> <allow|deny> <regexp>",
+// the regexps are matched case insensitively and the empty lines and # comments are skipped .
+func loadUARules() error {
+	if *uaRulesFile == "" {
+		return nil
+	}
+	f, err := os.Open(*uaRulesFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rules := []uaRule{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || (fields[1] != "allow" && fields[1] != "deny") {
+			return fmt.Errorf("%s:%d: expected <domain|*> <allow|deny> <regexp>", *uaRulesFile, n)
+		}
+		re, err := regexp.Compile("(?i)" + strings.Join(fields[2:], " "))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", *uaRulesFile, n, err)
+		}
+		rules = append(rules, uaRule{fields[0], fields[1] == "allow", re})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	uaRulesMu.Lock()
+	uaRules = rules
+	uaRulesMu.Unlock()
+	return nil
+}
+
+// the loaded user agent rules as their lines
+func uaRulesState() interface{} {
+	uaRulesMu.RLock()
+	defer uaRulesMu.RUnlock()
+	lines := []string{}
+	for _, rule := range uaRules {
+		action := "deny"
+		if rule.allow {
+			action = "allow"
+		}
+		lines = append(lines, rule.domain+" "+action+" "+strings.TrimPrefix(rule.re.String(), "(?i)"))
+	}
+	return lines
+}
+
+// whether the user agent of the request is blocked,
+// an allow rule always wins over the deny rules .
+func uaBlocked(r *http.Request) bool {
+	ua := r.UserAgent()
+	uaRulesMu.RLock()
+	defer uaRulesMu.RUnlock()
+	blocked := false
+	for _, rule := range uaRules {
+		if (rule.domain != "*" && rule.domain != r.Host) || !rule.re.MatchString(ua) {
+			continue
+		}
+		if rule.allow {
+			return false
+		}
+		blocked = true
+	}
+	return blocked
+}
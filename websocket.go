@@ -0,0 +1,303 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the open websocket connections of each client ip
+var wsConns = &ipCounter{counts: map[string]int{}}
+
+// the websocket connections closed because a peer didn't keep up
+var wsStalled = expvar.NewInt("ws_stalled_connections")
+
+// the websocket write timeout of each domain
+var domain_ws_write_timeout = map[string]time.Duration{}
+
+// parse the -ws-write-timeout flag of domain->timeout
+func parseWsWriteTimeouts(s string) {
+	for domain, value := range parseZones(s) {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("-ws-write-timeout: %s: %v", domain, err)
+		}
+		domain_ws_write_timeout[domain] = timeout
+	}
+}
+
+// the websocket read idle timeout of each domain, after which a connection with no traffic
+// either way is closed as its client being idle .
+var domain_ws_read_idle = map[string]time.Duration{}
+
+// the websocket write idle timeout of each domain, after which a connection with no traffic
+// either way is closed as its backend being idle .
+var domain_ws_write_idle = map[string]time.Duration{}
+
+// the websocket connections closed for being idle
+var wsIdleClosed = expvar.NewInt("ws_idle_connections")
+
+// parse the -ws-read-idle or -ws-write-idle flag of domain->timeout into the specified map
+func parseWsIdleTimeouts(name, s string, timeouts map[string]time.Duration) {
+	for domain, value := range parseZones(s) {
+		timeout, err := time.ParseDuration(value)
+		if err != nil {
+			log.Fatalf("-%s: %s: %v", name, domain, err)
+		}
+		timeouts[domain] = timeout
+	}
+}
+
+// a reader whose deadline slides with the traffic of both directions, so only genuine silence times it out,
+// last is the time of the latest read of either side, in unix nanoseconds .
+type idleReader struct {
+	r       io.Reader
+	conn    net.Conn
+	timeout time.Duration
+	side    string
+	last    *atomic.Int64
+}
+
+// a side of a websocket that has been silent for too long
+type idleError struct {
+	side    string
+	timeout time.Duration
+}
+
+func (e *idleError) Error() string {
+	return e.side + " idle for " + e.timeout.String()
+}
+
+func (ir idleReader) Read(b []byte) (int, error) {
+	if ir.timeout <= 0 {
+		return ir.r.Read(b)
+	}
+	for {
+		ir.conn.SetReadDeadline(time.Unix(0, ir.last.Load()).Add(ir.timeout))
+		n, err := ir.r.Read(b)
+		if n > 0 {
+			ir.last.Store(time.Now().UnixNano())
+		}
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			// the other direction kept the connection busy meanwhile
+			if time.Since(time.Unix(0, ir.last.Load())) < ir.timeout {
+				continue
+			}
+			err = &idleError{ir.side, ir.timeout}
+		}
+		return n, err
+	}
+}
+
+// relay the websocket traffic between the client and the backend,
+// the copies only hold a fixed size buffer, so a slow side naturally slows
+// the other one down, and with a write timeout a side that stops accepting
+// data for that long gets both connections closed instead of piling up .
+// the side still keeping up is sent a policy violation close frame first, 1008, the relay doesn't
+// parse the frames so like with -ws-drain-policy notify a frame it was midway relaying is cut .
+// with the idle timeouts a connection with no traffic either way for that long gets them closed too .
+func pipeWebsocket(domain string, clientConn, backConn net.Conn, fromClient io.Reader) {
+	ws := websockets.add(clientConn, backConn)
+	defer websockets.remove(ws)
+	timeout := domain_ws_write_timeout[domain]
+	last := &atomic.Int64{}
+	last.Store(time.Now().UnixNano())
+	fromClient = idleReader{fromClient, clientConn, domain_ws_read_idle[domain], "client", last}
+	fromBackend := idleReader{backConn, backConn, domain_ws_write_idle[domain], "backend", last}
+	idle := func(err error) {
+		var idle *idleError
+		if errors.As(err, &idle) {
+			wsIdleClosed.Add(1)
+			log.Printf("%s: websocket %v, closing", domain, idle)
+			clientConn.Close()
+			backConn.Close()
+		}
+	}
+	clientDone := make(chan struct{})
+	go func() {
+		defer close(clientDone)
+		_, err := io.Copy(deadlineWriter{backConn, timeout}, fromClient)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the relay to the client stops so the close frame follows the whole of what it relayed
+			ws.backendStalled.Store(true)
+			backConn.Close()
+			return
+		}
+		idle(err)
+	}()
+	_, err := io.Copy(deadlineWriter{clientConn, timeout}, fromBackend)
+	switch {
+	case ws.goingAway.Load():
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		clientConn.Write(wsCloseFrame(wsCloseGoingAway, false))
+	case ws.backendStalled.Load():
+		wsStalled.Add(1)
+		log.Printf("%s: websocket backend didn't keep up for %s, closing", domain, timeout)
+		clientConn.SetWriteDeadline(time.Now().Add(time.Second))
+		clientConn.Write(wsCloseFrame(wsClosePolicyViolation, false))
+		clientConn.Close()
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		wsStalled.Add(1)
+		log.Printf("%s: websocket client didn't keep up for %s, closing", domain, timeout)
+		clientConn.Close()
+		<-clientDone
+		backConn.SetWriteDeadline(time.Now().Add(time.Second))
+		backConn.Write(wsCloseFrame(wsClosePolicyViolation, true))
+		backConn.Close()
+	default:
+		idle(err)
+	}
+}
+
+// the close codes sent by the relay
+const (
+	// the server is going away, so the client reconnects
+	wsCloseGoingAway = 1001
+	// the peer didn't keep up
+	wsClosePolicyViolation = 1008
+)
+
+// a websocket close frame with the specified code, the frames sent to a backend
+// stand for the client's, which must be masked .
+func wsCloseFrame(code int, masked bool) []byte {
+	payload := []byte{byte(code >> 8), byte(code)}
+	if !masked {
+		return append([]byte{0x88, byte(len(payload))}, payload...)
+	}
+	frame := []byte{0x88, 0x80 | byte(len(payload)), 0, 0, 0, 0}
+	rand.Read(frame[2:6])
+	for i, b := range payload {
+		frame = append(frame, b^frame[2+i%4])
+	}
+	return frame
+}
+
+// a relayed websocket connection
+type websocket struct {
+	client, back   net.Conn
+	goingAway      atomic.Bool
+	backendStalled atomic.Bool
+}
+
+// the relayed websocket connections, for the shutdown to drain them
+type wsRegistry struct {
+	mu    sync.Mutex
+	conns map[*websocket]bool
+	wg    sync.WaitGroup
+}
+
+var websockets = &wsRegistry{conns: map[*websocket]bool{}}
+
+func (reg *wsRegistry) add(client, back net.Conn) *websocket {
+	ws := &websocket{client: client, back: back}
+	reg.mu.Lock()
+	reg.conns[ws] = true
+	reg.wg.Add(1)
+	reg.mu.Unlock()
+	return ws
+}
+
+func (reg *wsRegistry) remove(ws *websocket) {
+	reg.mu.Lock()
+	delete(reg.conns, ws)
+	reg.wg.Done()
+	reg.mu.Unlock()
+}
+
+// apply the function to every relayed websocket
+func (reg *wsRegistry) each(f func(*websocket)) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for ws := range reg.conns {
+		f(ws)
+	}
+}
+
+// wait for the websockets to close, up to the timeout, it returns whether they all did
+func (reg *wsRegistry) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		reg.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drain the websockets on shutdown as per -ws-drain-policy,
+// force closes them right away, wait lets them close on their own for up to -ws-drain-timeout
+// and notify sends the clients a going away close frame first .
+// the relay doesn't parse the frames, so with notify the close frame follows what the backend had sent and
+// a frame it was midway sending is cut, the clients still get told to reconnect .
+func drainWebsockets() {
+	switch *wsDrainPolicy {
+	case "notify":
+		websockets.each(func(ws *websocket) {
+			ws.goingAway.Store(true)
+			ws.back.Close()
+		})
+		fallthrough
+	case "wait":
+		if websockets.wait(*wsDrainTimeout) {
+			return
+		}
+		log.Printf("websockets still open after -ws-drain-timeout %s, closing them", *wsDrainTimeout)
+	}
+	websockets.each(func(ws *websocket) {
+		ws.client.Close()
+		ws.back.Close()
+	})
+	websockets.wait(time.Second)
+}
+
+// a writer that fails the writes not accepted within the timeout, zero means no timeout .
+// it doesn't embed the connection so io.Copy can't bypass it via ReadFrom .
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (d deadlineWriter) Write(b []byte) (int, error) {
+	if d.timeout > 0 {
+		d.conn.SetWriteDeadline(time.Now().Add(d.timeout))
+	}
+	return d.conn.Write(b)
+}
+
+// the upgrade protocols allowed on each domain besides the default ones
+var domain_upgrades = map[string][]string{}
+
+// parse the -upgrade-allow flag of domain->protocol|protocol
+func parseUpgradeAllow(s string) {
+	for domain, protocols := range parseZones(s) {
+		domain_upgrades[domain] = strings.Split(protocols, "|")
+	}
+}
+
+// whether every protocol of the specified Upgrade header is allowed on the domain,
+// websocket is allowed unless the domain has its own list .
+func upgradeAllowed(domain, upgrade string) bool {
+	allowed, found := domain_upgrades[domain]
+	if !found {
+		allowed = []string{"websocket"}
+	}
+	for _, protocol := range strings.Split(upgrade, ",") {
+		name := strings.TrimSpace(strings.SplitN(protocol, "/", 2)[0])
+		if name != "" && !containsFold(allowed, name) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// relay a websocket over pipes with a 50ms write timeout, returning the client and backend ends
+func pipedWebsocket(t *testing.T) (client, backend net.Conn, done chan struct{}) {
+	t.Helper()
+	saved := domain_ws_write_timeout
+	t.Cleanup(func() { domain_ws_write_timeout = saved })
+	domain_ws_write_timeout = map[string]time.Duration{"a.test": 50 * time.Millisecond}
+	clientConn, client := net.Pipe()
+	backConn, backend := net.Pipe()
+	t.Cleanup(func() { client.Close(); backend.Close() })
+	done = make(chan struct{})
+	go func() {
+		defer close(done)
+		pipeWebsocket("a.test", clientConn, backConn, clientConn)
+	}()
+	return client, backend, done
+}
+
+// read a close frame and return its code, unmasking it when needed
+func readCloseCode(t *testing.T, c net.Conn) int {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[0] != 0x88 || header[1]&0x7f != 2 {
+		t.Fatalf("not a close frame: % x", header)
+	}
+	mask := []byte{0, 0, 0, 0}
+	if header[1]&0x80 != 0 {
+		io.ReadFull(c, mask)
+	}
+	payload := make([]byte, 2)
+	if _, err := io.ReadFull(c, payload); err != nil {
+		t.Fatal(err)
+	}
+	return int(payload[0]^mask[0])<<8 | int(payload[1]^mask[1])
+}
+
+func TestWebsocketSlowClient(t *testing.T) {
+	client, backend, done := pipedWebsocket(t)
+	defer client.Close()
+	// the client never reads, the backend gets a masked 1008 once the write times out
+	go backend.Write([]byte("a message the client doesn't read"))
+	if code := readCloseCode(t, backend); code != wsClosePolicyViolation {
+		t.Fatalf("the backend got close code %d, want 1008", code)
+	}
+	<-done
+}
+
+func TestWebsocketSlowBackend(t *testing.T) {
+	client, backend, done := pipedWebsocket(t)
+	defer backend.Close()
+	// the backend never reads, the client gets a 1008 once the write times out
+	go client.Write([]byte("a message the backend doesn't read"))
+	if code := readCloseCode(t, client); code != wsClosePolicyViolation {
+		t.Fatalf("the client got close code %d, want 1008", code)
+	}
+	<-done
+}
+
+func TestWsCloseFrame(t *testing.T) {
+	if frame := wsCloseFrame(wsCloseGoingAway, false); !bytes.Equal(frame, []byte{0x88, 0x02, 0x03, 0xe9}) {
+		t.Fatalf("got % x", frame)
+	}
+	frame := wsCloseFrame(wsClosePolicyViolation, true)
+	if len(frame) != 8 || frame[1] != 0x82 || frame[6]^frame[2] != 0x03 || frame[7]^frame[3] != 0xf0 {
+		t.Fatalf("got % x", frame)
+	}
+}
+
+func TestWebsocketIdleOneWayStream(t *testing.T) {
+	defer func(read, write map[string]time.Duration) {
+		domain_ws_read_idle, domain_ws_write_idle = read, write
+	}(domain_ws_read_idle, domain_ws_write_idle)
+	domain_ws_read_idle = map[string]time.Duration{"a.test": 100 * time.Millisecond}
+	domain_ws_write_idle = map[string]time.Duration{"a.test": 100 * time.Millisecond}
+	client, backend, done := pipedWebsocket(t)
+	// the backend pushes for three times the idle timeout while the client stays silent
+	go func() {
+		for i := 0; i < 30; i++ {
+			if _, err := backend.Write([]byte("push")); err != nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	b := make([]byte, 4)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 30; i++ {
+		if _, err := io.ReadFull(client, b); err != nil {
+			t.Fatalf("the busy one way stream was closed after %d messages: %v", i, err)
+		}
+	}
+	// once the stream stops the connection is closed for being idle
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the idle connection wasn't closed")
+	}
+}